@@ -0,0 +1,311 @@
+package csv
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// Alerter compares the counts of each finished bucket with a baseline of
+// past buckets: the mean of the same time of day over the last
+// alert_days days ("same_hour"), or an exponentially weighted moving
+// average of all buckets ("ewma"). Baselines are kept in alert_state_file.
+type Alerter struct {
+	mode        string
+	days        int
+	alpha       float64
+	min_ratio   float64
+	error_ratio float64
+	min_count   float64
+	file        string
+	state       alertState
+}
+
+type alertState struct {
+	// start of the last checked bucket
+	Last    int64                        `json:"last"`
+	Ewma    map[string]float64           `json:"ewma,omitempty"`
+	History map[string]map[int64][]int64 `json:"history,omitempty"`
+}
+
+type alertResult struct {
+	dims      string
+	kind      string
+	value     float64
+	baseline  float64
+	threshold float64
+}
+
+func NewAlerter(conf *BylogFilterConfig) (*Alerter, error) {
+	a := &Alerter{
+		mode:        conf.AlertBaseline,
+		days:        conf.AlertDays,
+		alpha:       conf.AlertEwmaAlpha,
+		min_ratio:   conf.AlertMinRatio,
+		error_ratio: conf.AlertErrorRatio,
+		min_count:   float64(conf.AlertMinCount),
+		file:        conf.AlertStateFile,
+	}
+	switch a.mode {
+	case "same_hour":
+		if a.days <= 0 {
+			return nil, fmt.Errorf("alert_days must be positive")
+		}
+	case "ewma":
+		if a.alpha <= 0 || a.alpha > 1 {
+			return nil, fmt.Errorf("alert_ewma_alpha must be in (0, 1]")
+		}
+	default:
+		return nil, fmt.Errorf("alert_baseline must be same_hour or ewma")
+	}
+
+	a.state.Ewma = make(map[string]float64)
+	a.state.History = make(map[string]map[int64][]int64)
+	if len(a.file) > 0 {
+		b, err := ioutil.ReadFile(a.file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err = json.Unmarshal(b, &a.state); err != nil {
+				return nil, fmt.Errorf("%s: %v", a.file, err)
+			}
+			if a.state.Ewma == nil {
+				a.state.Ewma = make(map[string]float64)
+			}
+			if a.state.History == nil {
+				a.state.History = make(map[string]map[int64][]int64)
+			}
+		}
+	}
+	return a, nil
+}
+
+func (a *Alerter) Last() int64 {
+	return a.state.Last
+}
+
+// Check evaluates the bucket [start, start+interval) with the counts by
+// dimensions, then adds them to the baselines. Keys with a baseline but no
+// counts are checked with zero counts. Keys in other are never alerted.
+func (a *Alerter) Check(start, interval int64, counts map[string][]int, other string) []alertResult {
+	if start <= a.state.Last {
+		return nil
+	}
+	a.state.Last = start
+	slot := (start % 86400) / interval
+
+	keys := make(map[string]bool)
+	for dims := range counts {
+		keys[dims] = true
+	}
+	for dims := range a.state.Ewma {
+		keys[dims] = true
+	}
+	for dims := range a.state.History {
+		keys[dims] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for dims := range keys {
+		if dims != other {
+			sorted = append(sorted, dims)
+		}
+	}
+	sort.Strings(sorted)
+
+	var results []alertResult
+	for _, dims := range sorted {
+		var total, errs int64
+		for t, count := range counts[dims] {
+			total += int64(count)
+			switch MetricType(t) {
+			case MTypeDropTimeError, MTypeDropJsonError, MTypeDropOtherError:
+				errs += int64(count)
+			}
+		}
+
+		if baseline, ok := a.baseline(dims, slot); ok && baseline >= a.min_count {
+			if threshold := baseline * a.min_ratio; float64(total) < threshold {
+				results = append(results, alertResult{dims, "volume_drop", float64(total), baseline, threshold})
+			}
+		}
+		if a.error_ratio > 0 && total > 0 && float64(total) >= a.min_count {
+			if ratio := float64(errs) / float64(total); ratio > a.error_ratio {
+				results = append(results, alertResult{dims, "error_ratio", ratio, 0, a.error_ratio})
+			}
+		}
+		a.update(dims, slot, total)
+	}
+
+	if err := a.save(); err != nil {
+		LogError.Printf("save alert state %s: %v\n", a.file, err)
+	}
+	return results
+}
+
+func (a *Alerter) baseline(dims string, slot int64) (float64, bool) {
+	if a.mode == "ewma" {
+		e, ok := a.state.Ewma[dims]
+		return e, ok
+	}
+	hist := a.state.History[dims][slot]
+	if len(hist) == 0 {
+		return 0, false
+	}
+	var sum int64
+	for _, count := range hist {
+		sum += count
+	}
+	return float64(sum) / float64(len(hist)), true
+}
+
+// update adds a count to the baseline of dims, dropping baselines that
+// only saw zeros.
+func (a *Alerter) update(dims string, slot int64, total int64) {
+	if a.mode == "ewma" {
+		e, ok := a.state.Ewma[dims]
+		if !ok {
+			if total > 0 {
+				a.state.Ewma[dims] = float64(total)
+			}
+			return
+		}
+		e = a.alpha*float64(total) + (1-a.alpha)*e
+		if e < 0.5 {
+			delete(a.state.Ewma, dims)
+		} else {
+			a.state.Ewma[dims] = e
+		}
+		return
+	}
+
+	slots, ok := a.state.History[dims]
+	if !ok {
+		if total == 0 {
+			return
+		}
+		slots = make(map[int64][]int64)
+		a.state.History[dims] = slots
+	}
+	hist := slots[slot]
+	if len(hist) == 0 && total == 0 {
+		return
+	}
+	hist = append(hist, total)
+	if len(hist) > a.days {
+		hist = hist[len(hist)-a.days:]
+	}
+	zero := true
+	for _, count := range hist {
+		if count > 0 {
+			zero = false
+			break
+		}
+	}
+	if zero {
+		delete(slots, slot)
+	} else {
+		slots[slot] = hist
+	}
+	if len(slots) == 0 {
+		delete(a.state.History, dims)
+	}
+}
+
+func (a *Alerter) save() error {
+	if len(a.file) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(a.state)
+	if err != nil {
+		return err
+	}
+	tmp := a.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.file)
+}
+
+// checkAlerts runs the alerter over the buckets finished by now, with the
+// counts flushed for them by bucket start, and injects a BylogAlert
+// message for each violation. Buckets that started before the counts were
+// complete, as after a start without state_file, are skipped.
+func (f *BylogFilter) checkAlerts(now time.Time, finished map[int64]map[string][]int) {
+	var interval int64 = 3600
+	var starts []int64
+	if f.config.BucketBy == "log_at" {
+		interval = f.config.BucketInterval
+		latest := now.Unix() - f.config.LatenessGrace - interval
+		latest -= latest % interval
+		first := f.alerter.Last() + interval
+		if f.alerter.Last() == 0 || latest-first > 86400 {
+			first = latest
+		}
+		for start := first; start <= latest; start += interval {
+			starts = append(starts, start)
+		}
+	} else {
+		starts = append(starts, now.Add(-time.Hour).Truncate(time.Hour).Unix())
+	}
+
+	other := otherDims(len(f.dims))
+	for _, start := range starts {
+		if start < f.alert_since {
+			continue
+		}
+		for _, r := range f.alerter.Check(start, interval, finished[start], other) {
+			f.deliverAlert(start, r)
+		}
+	}
+}
+
+func (f *BylogFilter) deliverAlert(start int64, r alertResult) {
+	const msgType = "BylogAlert"
+
+	type A struct {
+		Time      string            `json:"time"`
+		StartAt   int64             `json:"start_at"`
+		Host      string            `json:"host"`
+		Dims      map[string]string `json:"dims"`
+		Kind      string            `json:"kind"`
+		Value     float64           `json:"value"`
+		Baseline  float64           `json:"baseline,omitempty"`
+		Threshold float64           `json:"threshold"`
+	}
+	alert := A{
+		Time:      time.Unix(start, 0).Format("2006-01-02 15:04:05"),
+		StartAt:   start,
+		Host:      fmt.Sprintf("%s:%d", f.hostname, f.pid),
+		Dims:      make(map[string]string),
+		Kind:      r.kind,
+		Value:     r.value,
+		Baseline:  r.baseline,
+		Threshold: r.threshold,
+	}
+	for i, value := range splitDims(r.dims) {
+		if i < len(f.dims) {
+			alert.Dims[f.dims[i].label] = value
+		}
+	}
+	b, err := json.Marshal(alert)
+	if err != nil {
+		LogError.Println("marshal alert fail:", err)
+		return
+	}
+	LogInfo.Println("alert:", string(b))
+
+	pack := f.h.PipelinePack(0)
+	if pack == nil {
+		LogError.Println("exceeded MaxMsgLoops =", f.h.PipelineConfig().Globals.MaxMsgLoops)
+		return
+	}
+	pack.Message.SetLogger(f.fr.Name())
+	pack.Message.SetType(msgType)
+	pack.Message.SetPayload(string(b))
+	f.fr.Inject(pack)
+}
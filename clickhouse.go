@@ -0,0 +1,236 @@
+package csv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClickHouseOutput batches encoded rows like PgOutput and inserts them
+// through the ClickHouse http interface.
+type ClickHouseOutput struct {
+	config    *ClickHouseOutputConfig
+	client    *http.Client
+	delimiter string
+}
+
+type ClickHouseOutputConfig struct {
+	Url      string `toml:"url"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	Database string `toml:"database"`
+	Table    string `toml:"table"`
+	// ApiName to table, others go to table.
+	Tables map[string]string `toml:"tables"`
+	// Columns of the insert, all columns of the table when not set.
+	Columns []string `toml:"columns"`
+	// Rows are sent as "TSV" or "CSV".
+	Format string `toml:"format"`
+	// Row delimiter when the encoder is not a CsvEncoder.
+	Delimiter     string `toml:"delimiter"`
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval int    `toml:"flush_interval"`
+	BatchMaxBytes int    `toml:"batch_max_bytes"`
+	Timeout       int    `toml:"timeout"`
+	RetryTimes    int    `toml:"retry_times"`
+	RetryInterval int    `toml:"retry_interval"`
+}
+
+func (co *ClickHouseOutput) ConfigStruct() interface{} {
+	return &ClickHouseOutputConfig{
+		Url:           "http://127.0.0.1:8123/",
+		Database:      "default",
+		Format:        "TSV",
+		Delimiter:     ",",
+		BatchSize:     1000,
+		FlushInterval: 60,
+		BatchMaxBytes: 16 << 20,
+		Timeout:       30,
+		RetryTimes:    3,
+		RetryInterval: 1000,
+	}
+}
+
+func (co *ClickHouseOutput) Init(config interface{}) (err error) {
+	co.config = config.(*ClickHouseOutputConfig)
+
+	if len(co.config.Url) == 0 {
+		return fmt.Errorf("url not set")
+	}
+	if len(co.config.Table) == 0 {
+		return fmt.Errorf("table not set")
+	}
+	switch co.config.Format {
+	case "TSV", "CSV":
+	default:
+		return fmt.Errorf("format must be TSV or CSV")
+	}
+	if co.config.BatchSize <= 0 {
+		return fmt.Errorf("batch_size must be positive")
+	}
+	if co.config.FlushInterval <= 0 {
+		return fmt.Errorf("flush_interval must be positive")
+	}
+	co.client = &http.Client{Timeout: time.Duration(co.config.Timeout) * time.Second}
+	return nil
+}
+
+func (co *ClickHouseOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required")
+	}
+	co.delimiter = co.config.Delimiter
+	if en, ok := or.Encoder().(*CsvEncoder); ok {
+		co.delimiter = en.config.Delimiter
+	}
+
+	var outBytes []byte
+	var e error
+
+	timer := time.NewTicker(time.Duration(co.config.FlushInterval) * time.Second)
+	defer timer.Stop()
+	batch := newApiBatch(co.config.BatchSize)
+	for {
+		select {
+		case pack, ok := <-or.InChan():
+			if !ok {
+				co.flush(or, batch, "shutdown")
+				return
+			}
+			if outBytes, e = or.Encode(pack); e != nil {
+				or.LogError(fmt.Errorf("Error encoding message: %s", e.Error()))
+			} else if outBytes != nil {
+				if co.config.BatchMaxBytes > 0 && batch.bytes+len(outBytes) > co.config.BatchMaxBytes {
+					co.flush(or, batch, "bytes")
+				}
+				batch.add(packApiName(pack), string(outBytes))
+				if len(batch.points) >= co.config.BatchSize {
+					co.flush(or, batch, "size")
+				}
+			}
+			pack.Recycle()
+		case <-timer.C:
+			co.flush(or, batch, "timer")
+		}
+	}
+	return
+}
+
+func (co *ClickHouseOutput) flush(or OutputRunner, batch *apiBatch, by string) {
+	if len(batch.points) == 0 {
+		return
+	}
+	order, groups := batch.groups()
+	for _, api := range order {
+		n := len(groups[api])
+		if e := co.insertRetry(api, groups[api]); e != nil {
+			or.LogError(fmt.Errorf("fail send points: %s, %d, %v", api, n, e))
+		} else {
+			or.LogMessage(fmt.Sprintf("send points to clickhouse success(by %s): %s i = %d", by, api, n))
+		}
+	}
+	batch.reset()
+}
+
+func (co *ClickHouseOutput) insertRetry(api string, points []string) (err error) {
+	interval := time.Duration(co.config.RetryInterval) * time.Millisecond
+	for n := 0; ; n++ {
+		if err = co.insert(api, points); err == nil || n >= co.config.RetryTimes {
+			return
+		}
+		LogError.Printf("insert fail, retry %d in %s: %v\n", n+1, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (co *ClickHouseOutput) tableFor(api string) string {
+	if table, ok := co.config.Tables[api]; ok {
+		return table
+	}
+	return co.config.Table
+}
+
+func (co *ClickHouseOutput) insertQuery(api string) string {
+	query := "INSERT INTO " + clickHouseQuote(co.config.Database) + "." + clickHouseQuote(co.tableFor(api))
+	if len(co.config.Columns) > 0 {
+		quoted := make([]string, len(co.config.Columns))
+		for i, c := range co.config.Columns {
+			quoted[i] = clickHouseQuote(c)
+		}
+		query += " (" + strings.Join(quoted, ", ") + ")"
+	}
+	if co.config.Format == "CSV" {
+		return query + " FORMAT CSV"
+	}
+	return query + " FORMAT TabSeparated"
+}
+
+// insert re-encodes the delimited rows in the configured format, so the
+// encoder delimiter never clashes with ClickHouse escaping.
+func (co *ClickHouseOutput) insert(api string, points []string) error {
+	var body bytes.Buffer
+	for _, p := range points {
+		fields := strings.Split(strings.TrimRight(p, "\r\n"), co.delimiter)
+		for i, f := range fields {
+			if i > 0 {
+				if co.config.Format == "CSV" {
+					body.WriteByte(',')
+				} else {
+					body.WriteByte('\t')
+				}
+			}
+			if co.config.Format == "CSV" {
+				body.WriteString(`"` + strings.Replace(f, `"`, `""`, -1) + `"`)
+			} else {
+				body.WriteString(tsvEscaper.Replace(f))
+			}
+		}
+		body.WriteByte('\n')
+	}
+
+	u, err := url.Parse(co.config.Url)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("query", co.insertQuery(api))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &body)
+	if err != nil {
+		return err
+	}
+	if len(co.config.User) > 0 {
+		req.SetBasicAuth(co.config.User, co.config.Password)
+	}
+	resp, err := co.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("clickhouse: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func clickHouseQuote(name string) string {
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+func init() {
+	RegisterPlugin("ClickHouseOutput", func() interface{} {
+		return new(ClickHouseOutput)
+	})
+}
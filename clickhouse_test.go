@@ -0,0 +1,142 @@
+package csv
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+type clickHouseRequest struct {
+	query string
+	body  string
+}
+
+// clickHouseStandIn records the inserts it receives and answers them with
+// status.
+type clickHouseStandIn struct {
+	sync.Mutex
+	status   int
+	requests []clickHouseRequest
+}
+
+func (s *clickHouseStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	s.requests = append(s.requests, clickHouseRequest{r.URL.Query().Get("query"), string(body)})
+	s.Unlock()
+	if s.status != http.StatusOK {
+		http.Error(w, "Code: 60. DB::Exception: Table doesn't exist", s.status)
+	}
+}
+
+func newTestClickHouse(t *testing.T, status int, setup func(*ClickHouseOutputConfig)) (*ClickHouseOutput, *clickHouseStandIn) {
+	pipeline.LogError = log.New(ioutil.Discard, "", 0)
+	pipeline.LogInfo = log.New(ioutil.Discard, "", 0)
+
+	standIn := &clickHouseStandIn{status: status}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	co := new(ClickHouseOutput)
+	config := co.ConfigStruct().(*ClickHouseOutputConfig)
+	config.Url = server.URL + "/"
+	config.Table = "events"
+	config.RetryInterval = 1
+	if setup != nil {
+		setup(config)
+	}
+	if err := co.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	co.delimiter = config.Delimiter
+	return co, standIn
+}
+
+func TestClickHouseTableRouting(t *testing.T) {
+	co, standIn := newTestClickHouse(t, http.StatusOK, func(config *ClickHouseOutputConfig) {
+		config.Tables = map[string]string{"user_login": "logins"}
+		config.Columns = []string{"ftime", "fuid"}
+	})
+
+	for _, api := range []string{"user_login", "user_pay"} {
+		if err := co.insertRetry(api, []string{"2016-01-02 03:04:05,42\n"}); err != nil {
+			t.Fatalf("%s: %v", api, err)
+		}
+	}
+
+	want := []string{
+		"INSERT INTO `default`.`logins` (`ftime`, `fuid`) FORMAT TabSeparated",
+		"INSERT INTO `default`.`events` (`ftime`, `fuid`) FORMAT TabSeparated",
+	}
+	if len(standIn.requests) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(standIn.requests), len(want))
+	}
+	for i, query := range want {
+		if standIn.requests[i].query != query {
+			t.Errorf("query %d: got %q, want %q", i, standIn.requests[i].query, query)
+		}
+	}
+}
+
+func TestClickHouseEscaping(t *testing.T) {
+	tests := []struct {
+		format    string
+		delimiter string
+		points    []string
+		body      string
+	}{
+		{
+			format:    "TSV",
+			delimiter: ",",
+			points:    []string{"a\tb,c\\d,e\nf\n", "g,h\n"},
+			body:      "a\\tb\tc\\\\d\te\\nf\ng\th\n",
+		},
+		{
+			format:    "CSV",
+			delimiter: "|",
+			points:    []string{"a,b|say \"hi\"|\tc\n"},
+			body:      "\"a,b\",\"say \"\"hi\"\"\",\"\tc\"\n",
+		},
+	}
+	for _, test := range tests {
+		co, standIn := newTestClickHouse(t, http.StatusOK, func(config *ClickHouseOutputConfig) {
+			config.Format = test.format
+			config.Delimiter = test.delimiter
+		})
+		if err := co.insertRetry("user_login", test.points); err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if len(standIn.requests) != 1 {
+			t.Fatalf("%s: got %d requests, want 1", test.format, len(standIn.requests))
+		}
+		if got := standIn.requests[0].body; got != test.body {
+			t.Errorf("%s: got body %q, want %q", test.format, got, test.body)
+		}
+		if !strings.HasSuffix(standIn.requests[0].query, "FORMAT "+map[string]string{"TSV": "TabSeparated", "CSV": "CSV"}[test.format]) {
+			t.Errorf("%s: got query %q", test.format, standIn.requests[0].query)
+		}
+	}
+}
+
+func TestClickHouseRetryThenError(t *testing.T) {
+	co, standIn := newTestClickHouse(t, http.StatusNotFound, func(config *ClickHouseOutputConfig) {
+		config.RetryTimes = 2
+	})
+
+	err := co.insertRetry("user_login", []string{"a,b\n"})
+	if err == nil {
+		t.Fatal("got no error for a failing server")
+	}
+	if !strings.Contains(err.Error(), "404") || !strings.Contains(err.Error(), "Table doesn't exist") {
+		t.Errorf("error does not carry the response: %v", err)
+	}
+	if len(standIn.requests) != 3 {
+		t.Errorf("got %d attempts, want 3", len(standIn.requests))
+	}
+}
@@ -0,0 +1,141 @@
+package csv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Condition tests a decoded log record. A leaf condition compares one key
+// of the record:
+//
+//	{"key": "type", "op": "in", "value": ["phone", "mobile"]}
+//
+// with op one of eq (default), ne, in, prefix or regex. Conditions are
+// combined with {"all": [...]}, {"any": [...]} and {"not": {...}}.
+type Condition struct {
+	Key   string       `json:"key"`
+	Op    string       `json:"op"`
+	Value interface{}  `json:"value"`
+	All   []*Condition `json:"all"`
+	Any   []*Condition `json:"any"`
+	Not   *Condition   `json:"not"`
+
+	values []string
+	re     *regexp.Regexp
+}
+
+func (c *Condition) Compile() (err error) {
+	for _, sub := range c.All {
+		if err = sub.Compile(); err != nil {
+			return
+		}
+	}
+	for _, sub := range c.Any {
+		if err = sub.Compile(); err != nil {
+			return
+		}
+	}
+	if c.Not != nil {
+		if err = c.Not.Compile(); err != nil {
+			return
+		}
+	}
+	if len(c.All) > 0 || len(c.Any) > 0 || c.Not != nil {
+		if len(c.Key) > 0 {
+			return fmt.Errorf("condition: key with all/any/not: %s", c.Key)
+		}
+		return nil
+	}
+
+	if len(c.Key) == 0 {
+		return fmt.Errorf("condition: key not set")
+	}
+	switch value := c.Value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			c.values = append(c.values, fmt.Sprintf("%v", v))
+		}
+	case nil:
+	default:
+		c.values = []string{fmt.Sprintf("%v", value)}
+	}
+
+	switch c.Op {
+	case "", "eq", "ne", "prefix":
+		if len(c.values) != 1 {
+			return fmt.Errorf("condition: %s needs one value: %s", c.Op, c.Key)
+		}
+	case "in":
+		if len(c.values) == 0 {
+			return fmt.Errorf("condition: in needs values: %s", c.Key)
+		}
+	case "regex":
+		if len(c.values) != 1 {
+			return fmt.Errorf("condition: regex needs one value: %s", c.Key)
+		}
+		if c.re, err = regexp.Compile(c.values[0]); err != nil {
+			return fmt.Errorf("condition: %s: %v", c.Key, err)
+		}
+	default:
+		return fmt.Errorf("condition: unknown op: %s", c.Op)
+	}
+	return nil
+}
+
+func (c *Condition) Match(jmap map[string]interface{}) bool {
+	if len(c.All) > 0 || len(c.Any) > 0 || c.Not != nil {
+		for _, sub := range c.All {
+			if !sub.Match(jmap) {
+				return false
+			}
+		}
+		if len(c.Any) > 0 {
+			matched := false
+			for _, sub := range c.Any {
+				if sub.Match(jmap) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+		if c.Not != nil && c.Not.Match(jmap) {
+			return false
+		}
+		return true
+	}
+
+	raw, ok := jmap[c.Key]
+	if !ok || raw == nil {
+		return c.Op == "ne"
+	}
+	var value string
+	switch v := raw.(type) {
+	case string:
+		value = v
+	default:
+		value = fmt.Sprintf("%v", v)
+	}
+
+	switch c.Op {
+	case "", "eq":
+		return value == c.values[0]
+	case "ne":
+		return value != c.values[0]
+	case "in":
+		for _, v := range c.values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	case "prefix":
+		return strings.HasPrefix(value, c.values[0])
+	case "regex":
+		return c.re.MatchString(value)
+	}
+	return false
+}
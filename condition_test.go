@@ -0,0 +1,76 @@
+package csv
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConditionMatch(t *testing.T) {
+	tests := []struct {
+		cond   string
+		record string
+		want   bool
+	}{
+		{`{"key": "type", "value": "phone"}`, `{"type": "phone"}`, true},
+		{`{"key": "type", "op": "eq", "value": "phone"}`, `{"type": "mail"}`, false},
+		{`{"key": "type", "value": "phone"}`, `{}`, false},
+		{`{"key": "level", "value": 3}`, `{"level": 3}`, true},
+		{`{"key": "ok", "value": true}`, `{"ok": true}`, true},
+		{`{"key": "type", "op": "ne", "value": "phone"}`, `{"type": "mail"}`, true},
+		{`{"key": "type", "op": "ne", "value": "phone"}`, `{"type": "phone"}`, false},
+		{`{"key": "type", "op": "ne", "value": "phone"}`, `{}`, true},
+		{`{"key": "type", "op": "in", "value": ["phone", "mobile"]}`, `{"type": "mobile"}`, true},
+		{`{"key": "type", "op": "in", "value": ["phone", "mobile"]}`, `{"type": "mail"}`, false},
+		{`{"key": "phone", "op": "prefix", "value": "+86"}`, `{"phone": "+8613800138000"}`, true},
+		{`{"key": "phone", "op": "prefix", "value": "+86"}`, `{"phone": "+4413800138000"}`, false},
+		{`{"key": "phone", "op": "regex", "value": "^1[3-9][0-9]{9}$"}`, `{"phone": "13800138000"}`, true},
+		{`{"key": "phone", "op": "regex", "value": "^1[3-9][0-9]{9}$"}`, `{"phone": "1380013800"}`, false},
+		{`{"all": [{"key": "a", "value": "1"}, {"key": "b", "value": "2"}]}`, `{"a": "1", "b": "2"}`, true},
+		{`{"all": [{"key": "a", "value": "1"}, {"key": "b", "value": "2"}]}`, `{"a": "1", "b": "3"}`, false},
+		{`{"any": [{"key": "a", "value": "1"}, {"key": "b", "value": "2"}]}`, `{"a": "0", "b": "2"}`, true},
+		{`{"any": [{"key": "a", "value": "1"}, {"key": "b", "value": "2"}]}`, `{"a": "0", "b": "0"}`, false},
+		{`{"not": {"key": "a", "value": "1"}}`, `{"a": "1"}`, false},
+		{`{"not": {"key": "a", "value": "1"}}`, `{"a": "0"}`, true},
+		{`{"all": [{"key": "a", "value": "1"}], "not": {"key": "b", "op": "in", "value": ["x", "y"]}}`, `{"a": "1", "b": "z"}`, true},
+		{`{"all": [{"key": "a", "value": "1"}], "not": {"key": "b", "op": "in", "value": ["x", "y"]}}`, `{"a": "1", "b": "y"}`, false},
+	}
+	for _, test := range tests {
+		c := &Condition{}
+		if err := json.Unmarshal([]byte(test.cond), c); err != nil {
+			t.Fatalf("%s: %v", test.cond, err)
+		}
+		if err := c.Compile(); err != nil {
+			t.Errorf("%s: %v", test.cond, err)
+			continue
+		}
+		record := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(test.record), &record); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Match(record); got != test.want {
+			t.Errorf("%s on %s: got %v, want %v", test.cond, test.record, got, test.want)
+		}
+	}
+}
+
+func TestConditionCompileErrors(t *testing.T) {
+	for _, cond := range []string{
+		`{"value": "phone"}`,
+		`{"key": "type"}`,
+		`{"key": "type", "value": ["a", "b"]}`,
+		`{"key": "type", "op": "in"}`,
+		`{"key": "type", "op": "regex", "value": "("}`,
+		`{"key": "type", "op": "like", "value": "a"}`,
+		`{"key": "type", "all": [{"key": "a", "value": "1"}]}`,
+		`{"any": [{"key": "a", "op": "prefix"}]}`,
+		`{"not": {"key": "a", "op": "in", "value": []}}`,
+	} {
+		c := &Condition{}
+		if err := json.Unmarshal([]byte(cond), c); err != nil {
+			t.Fatalf("%s: %v", cond, err)
+		}
+		if err := c.Compile(); err == nil {
+			t.Errorf("%s: got no error", cond)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package csv
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"regexp"
+	"strings"
+)
+
+// dimension is one part of the BylogFilter counter key, either a message
+// field ("Bpid", "ApiName", ...), the message "Hostname", or a dotted path
+// into JsonString written as "json:<path>".
+type dimension struct {
+	name  string
+	label string
+	json  bool
+}
+
+const (
+	dimSep   = "\x1f"
+	dimOther = "_other"
+)
+
+var dimLabels = map[string]string{
+	"Bpid":    "bpid",
+	"ApiName": "api",
+}
+
+// labelInvalid matches what a Prometheus label name can not hold.
+var labelInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func parseDimensions(names []string) ([]dimension, error) {
+	var dims []dimension
+	seen := make(map[string]bool)
+	for _, name := range names {
+		d := dimension{name: name}
+		if strings.HasPrefix(name, "json:") {
+			d.name = strings.TrimPrefix(name, "json:")
+			d.json = true
+		}
+		if len(d.name) == 0 {
+			return nil, fmt.Errorf("empty dimension: %q", name)
+		}
+		if label, ok := dimLabels[name]; ok {
+			d.label = label
+		} else {
+			d.label = strings.ToLower(labelInvalid.ReplaceAllString(d.name, "_"))
+			if d.label[0] >= '0' && d.label[0] <= '9' {
+				d.label = "_" + d.label
+			}
+		}
+		if d.label == "type" {
+			return nil, fmt.Errorf("dimension %s: label type is reserved for the metric type", name)
+		}
+		if seen[d.label] {
+			return nil, fmt.Errorf("duplicate dimension: %s", name)
+		}
+		seen[d.label] = true
+		dims = append(dims, d)
+	}
+	if len(dims) == 0 {
+		return nil, fmt.Errorf("dimensions not set")
+	}
+	return dims, nil
+}
+
+func dimKey(values []string) string {
+	clean := make([]string, len(values))
+	for i, v := range values {
+		clean[i] = strings.Replace(v, dimSep, "_", -1)
+	}
+	return strings.Join(clean, dimSep)
+}
+
+func splitDims(dims string) []string {
+	return strings.Split(dims, dimSep)
+}
+
+// otherDims is the key n dimensions fall back to past max_keys.
+func otherDims(n int) string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = dimOther
+	}
+	return dimKey(values)
+}
+
+var csvEscaper = strings.NewReplacer(",", "_", "\n", "_", "\r", "_")
+
+// csvSafe replaces the delimiter and line breaks in a value of the csv
+// output, which is split on "," without quoting.
+func csvSafe(value string) string {
+	return csvEscaper.Replace(value)
+}
+
+func messageFieldString(msg *message.Message, name string) string {
+	if name == "Hostname" {
+		return msg.GetHostname()
+	}
+	f := msg.FindFirstField(name)
+	if f == nil {
+		return ""
+	}
+	switch v := f.GetValue().(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
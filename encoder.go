@@ -23,13 +23,20 @@ type CsvEncoderConfig struct {
 	PrefixWithApi   bool   `toml:"prefix_with_apiname"`
 	ApiMapsFile     string `toml:"api_maps_file"`
 	LocationSvrAddr string `toml:"location_svr_addr"`
+	// Resolve ips from a local range file instead of location_svr_addr,
+	// reloaded when changed, checked every ip_location_interval seconds.
+	IpLocationFile     string `toml:"ip_location_file"`
+	IpLocationInterval int    `toml:"ip_location_interval"`
+	// Key of the "hash" field transform.
+	HashKeyFile string `toml:"hash_key_file"`
 }
 
 type CsvEncoder struct {
-	config                 *CsvEncoderConfig
-	apiconfigs             map[string]ApiConfig
-	api_ip_location_map    map[string]string
-	api_phone_location_map map[string]map[string]string
+	config         *CsvEncoderConfig
+	apiconfigs     map[string]ApiConfig
+	api_enrichers  map[string][]*apiEnricher
+	ip_location_db *IpLocationDB
+	hash_key       []byte
 }
 
 type ApiArg struct {
@@ -37,6 +44,9 @@ type ApiArg struct {
 	aType  string
 	aValue string
 	aKey   bool
+
+	aTransform string
+	aKeep      int
 }
 
 type ApiConfig struct {
@@ -50,6 +60,9 @@ type ApiFieldItem struct {
 	Type   string `xml:"Type"`
 	Dvalue string `xml:"Dvalue"`
 	IsKey  bool   `xml:"IsKey"`
+
+	Transform string `xml:"Transform"`
+	Keep      int    `xml:"Keep"`
 }
 
 type ApiFields struct {
@@ -61,14 +74,26 @@ type ApiFields struct {
 
 func (en *CsvEncoder) ConfigStruct() interface{} {
 	return &CsvEncoderConfig{
-		ApiPath:   "ApiConfig",
-		Delimiter: "\001",
+		ApiPath:            "ApiConfig",
+		Delimiter:          "\001",
+		IpLocationInterval: 60,
 	}
 }
 
 func (en *CsvEncoder) Init(config interface{}) (err error) {
 	en.config = config.(*CsvEncoderConfig)
 
+	if len(en.config.HashKeyFile) > 0 {
+		b, e := ioutil.ReadFile(en.config.HashKeyFile)
+		if e != nil {
+			return e
+		}
+		en.hash_key = []byte(strings.TrimSpace(string(b)))
+		if len(en.hash_key) == 0 {
+			return fmt.Errorf("hash_key_file is empty: %s", en.config.HashKeyFile)
+		}
+	}
+
 	files, err := filepath.Glob(fmt.Sprintf("%s/fd-*.xml", en.config.ApiPath))
 	if err != nil {
 		return err
@@ -114,6 +139,15 @@ func (en *CsvEncoder) Init(config interface{}) (err error) {
 				arg.aKey = false
 			}
 
+			if e = checkTransform(&i); e != nil {
+				return fmt.Errorf("xml: %v: %s, %d, %s", e, file, line, i.Name)
+			}
+			if i.Transform == "hash" && len(en.hash_key) == 0 {
+				return fmt.Errorf("xml: hash_key_file not set: %s, %d, %s", file, line, i.Name)
+			}
+			arg.aTransform = i.Transform
+			arg.aKeep = i.Keep
+
 			args = append(args, arg)
 		}
 
@@ -135,24 +169,15 @@ func (en *CsvEncoder) Init(config interface{}) (err error) {
 	if err != nil {
 		return err
 	}
-	if _, ok := m["api_ip_location_map"]; !ok {
-		return fmt.Errorf("api_ip_location_map not set")
-	}
-	if _, ok := m["api_phone_location_map"]; !ok {
-		return fmt.Errorf("api_phone_location_map not set")
-	}
-	en.api_ip_location_map = make(map[string]string)
-	for k, v := range m["api_ip_location_map"].(map[string]interface{}) {
-		en.api_ip_location_map[k] = v.(string)
-	}
-	en.api_phone_location_map = make(map[string]map[string]string)
-	for k, v := range m["api_phone_location_map"].(map[string]interface{}) {
-		en.api_phone_location_map[k] = make(map[string]string)
-		for k2, v2 := range v.(map[string]interface{}) {
-			en.api_phone_location_map[k][k2] = v2.(string)
+	if len(en.config.IpLocationFile) > 0 {
+		interval := time.Duration(en.config.IpLocationInterval) * time.Second
+		en.ip_location_db, err = NewIpLocationDB(en.config.IpLocationFile, interval)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+
+	return en.loadEnrichers(m)
 }
 
 func (en *CsvEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
@@ -185,11 +210,7 @@ func (en *CsvEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err er
 		return nil, fmt.Errorf("No ApiConfig: %s", api_name)
 	}
 
-	var e error
-	jdata, e = en.jsonAddLocationInfo(jdata, api_name)
-	if e != nil {
-		pipeline.LogError.Println(e)
-	}
+	en.enrich(jdata, api_name)
 
 	var csv_arr []string
 	if en.config.PrefixWithDate {
@@ -201,13 +222,13 @@ func (en *CsvEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err er
 	}
 	for _, arg := range apiconfig.args {
 		if arg.aName == "bpid" {
-			csv_arr = append(csv_arr, bpid)
+			csv_arr = append(csv_arr, en.transformField(&arg, bpid))
 			continue
 		}
 
 		if value := jdata[arg.aName]; value != nil {
 			if v, e := mapLogField(&arg, &value); e == nil {
-				csv_arr = append(csv_arr, v)
+				csv_arr = append(csv_arr, en.transformField(&arg, v))
 				continue
 			}
 		}
@@ -215,78 +236,18 @@ func (en *CsvEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err er
 		if arg.aKey {
 			err = fmt.Errorf("invalid log field: %s", arg.aName)
 		} else {
-			switch arg.aType {
-			case "int", "float":
-				csv_arr = append(csv_arr, "0")
-			case "datetime":
-				csv_arr = append(csv_arr, "1970-01-01 00:00:00")
-			case "datetime_float":
-				csv_arr = append(csv_arr, "1970-01-01 00:00:00.000")
-			case "str":
-				csv_arr = append(csv_arr, "")
-			default:
-				continue
-			}
+			csv_arr = append(csv_arr, typeEmptyValue(arg.aType))
 		}
 	}
 	line := strings.Join(csv_arr, en.config.Delimiter)
 	return []byte(line + "\n"), nil
 }
 
-func (en *CsvEncoder) jsonAddLocationInfo(jmap map[string]interface{}, api string) (map[string]interface{}, error) {
-	if len(en.config.LocationSvrAddr) == 0 {
-		return jmap, nil
+func (en *CsvEncoder) queryIpLocation(ip string) (map[string]interface{}, error) {
+	if en.ip_location_db != nil {
+		return en.ip_location_db.Lookup(ip)
 	}
-
-	if ip_key, ok := en.api_ip_location_map[api]; ok {
-		if ip_value, ok := jmap[ip_key]; ok {
-			switch ip := ip_value.(type) {
-			case string:
-				ipinfo, err := queryLocationInfo(en.config.LocationSvrAddr, "ip", ip)
-				if err == nil { /* Query OK */
-					jmap["x_country"] = ipinfo["country"].(string)
-					jmap["x_province"] = ipinfo["province"].(string)
-					jmap["x_city"] = ipinfo["city"].(string)
-					jmap["x_country_code"] = ipinfo["country_code"].(string)
-
-					return jmap, nil
-				} else {
-					return jmap, fmt.Errorf("queryLocationInfo fail: %v", err)
-				}
-			default:
-			}
-		}
-	}
-
-	if key_info, ok := en.api_phone_location_map[api]; ok {
-		if where, ok := key_info["where"]; ok {
-			if equal_to, ok := key_info["equal_to"]; ok {
-				if where_value, ok := jmap[where]; ok {
-					switch value := where_value.(type) {
-					case string:
-						if value == equal_to {
-							if transform, ok := key_info["transform"]; ok {
-								phone_info, err := queryLocationInfo(en.config.LocationSvrAddr, "phone", jmap[transform].(string))
-								if err == nil {
-									jmap["x_country"] = phone_info["country"].(string)
-									jmap["x_province"] = phone_info["province"].(string)
-									jmap["x_city"] = phone_info["city"].(string)
-									jmap["x_country_code"] = phone_info["country_code"].(string)
-
-									return jmap, nil
-								} else {
-									return jmap, fmt.Errorf("queryLocationInfo fail: %v", err)
-								}
-							}
-						}
-					default:
-					}
-				}
-			}
-		}
-	}
-
-	return jmap, nil
+	return queryLocationInfo(en.config.LocationSvrAddr, "ip", ip)
 }
 
 func init() {
@@ -315,6 +276,20 @@ func typeDefaultValue(t string) string {
 	}
 }
 
+// typeEmptyValue is written for a missing or dropped field.
+func typeEmptyValue(t string) string {
+	switch t {
+	case "int", "float":
+		return "0"
+	case "datetime":
+		return "1970-01-01 00:00:00"
+	case "datetime_float":
+		return "1970-01-01 00:00:00.000"
+	default:
+		return ""
+	}
+}
+
 func mapLogField(arg *ApiArg, value *interface{}) (v string, err error) {
 	v = arg.aValue
 
@@ -453,7 +428,8 @@ func queryLocationInfo(addr string, query string, target string) (map[string]int
 	switch c := obj["code"].(type) {
 	case float64:
 		if c != 0 {
-			return nil, fmt.Errorf("code not 0: %s: %s", obj["message"].(string), target)
+			message, _ := obj["message"].(string)
+			return nil, fmt.Errorf("code not 0: %v: %s: %s", c, message, target)
 		}
 		return obj, nil
 	default:
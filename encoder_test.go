@@ -0,0 +1,128 @@
+package csv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func testHmac(key, v string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestTransformField(t *testing.T) {
+	en := &CsvEncoder{hash_key: []byte("secret")}
+	tests := []struct {
+		arg   ApiArg
+		value string
+		want  string
+	}{
+		{ApiArg{aType: "str", aTransform: "hash"}, "13800138000", testHmac("secret", "13800138000")},
+		{ApiArg{aType: "str", aTransform: "hash"}, "", ""},
+		{ApiArg{aType: "str", aTransform: "ip_truncate"}, "10.1.2.3", "10.1.2.0"},
+		{ApiArg{aType: "str", aTransform: "ip_truncate"}, " 10.1.2.3 ", "10.1.2.0"},
+		{ApiArg{aType: "str", aTransform: "ip_truncate"}, "2001:db8:1:2:3::4", "2001:db8:1::"},
+		{ApiArg{aType: "str", aTransform: "ip_truncate"}, "not an ip", ""},
+		{ApiArg{aType: "str", aTransform: "mask", aKeep: 4}, "13800138000", "*******8000"},
+		{ApiArg{aType: "str", aTransform: "mask", aKeep: 2}, "张三丰", "*三丰"},
+		{ApiArg{aType: "str", aTransform: "mask", aKeep: 8}, "abc", "abc"},
+		{ApiArg{aType: "str", aTransform: "mask"}, "abc", "***"},
+		{ApiArg{aType: "str", aTransform: "drop"}, "abc", ""},
+		{ApiArg{aType: "int", aTransform: "drop"}, "42", "0"},
+		{ApiArg{aType: "datetime", aTransform: "drop"}, "2016-01-02 03:04:05", "1970-01-01 00:00:00"},
+		{ApiArg{aType: "str"}, "abc", "abc"},
+	}
+	for _, test := range tests {
+		if got := en.transformField(&test.arg, test.value); got != test.want {
+			t.Errorf("%s %q: got %q, want %q", test.arg.aTransform, test.value, got, test.want)
+		}
+	}
+}
+
+func TestCheckTransform(t *testing.T) {
+	for _, item := range []ApiFieldItem{
+		{Type: "str", Transform: "encrypt"},
+		{Type: "int", Transform: "hash"},
+		{Type: "float", Transform: "ip_truncate"},
+		{Type: "int", Transform: "mask"},
+		{Type: "str", Transform: "mask", Keep: -1},
+	} {
+		if err := checkTransform(&item); err == nil {
+			t.Errorf("%s of %s: got no error", item.Transform, item.Type)
+		}
+	}
+	for _, item := range []ApiFieldItem{
+		{Type: "str", Transform: "hash"},
+		{Type: "int", Transform: "drop"},
+		{Type: "str"},
+	} {
+		if err := checkTransform(&item); err != nil {
+			t.Errorf("%s of %s: %v", item.Transform, item.Type, err)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeTransforms(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "fd-user_login.xml"), `<Fields>
+	<Field Name="bpid"><Type>str</Type><Transform>hash</Transform></Field>
+	<Field Name="uid"><Type>str</Type><IsKey>true</IsKey></Field>
+	<Field Name="ip"><Type>str</Type><Transform>ip_truncate</Transform></Field>
+	<Field Name="phone"><Type>str</Type><Transform>mask</Transform><Keep>4</Keep></Field>
+	<Field Name="name"><Type>str</Type><Transform>drop</Transform></Field>
+</Fields>`)
+	writeTestFile(t, filepath.Join(dir, "api_maps.json"), `{}`)
+	writeTestFile(t, filepath.Join(dir, "hash.key"), "secret\n")
+
+	en := new(CsvEncoder)
+	config := en.ConfigStruct().(*CsvEncoderConfig)
+	config.ApiPath = dir
+	config.ApiMapsFile = filepath.Join(dir, "api_maps.json")
+	config.HashKeyFile = filepath.Join(dir, "hash.key")
+	config.Delimiter = ","
+	if err := en.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	pack := pipeline.NewPipelinePack(nil)
+	for _, kv := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"Bpid", "b1"},
+		{"ApiName", "user_login"},
+		{"LogAt", time.Now().Unix()},
+		{"JsonString", `{"uid":"u1","ip":"10.1.2.3","phone":"13800138000","name":"someone"}`},
+	} {
+		f, err := message.NewField(kv.name, kv.value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pack.Message.AddField(f)
+	}
+
+	b, err := en.Encode(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{testHmac("secret", "b1"), "u1", "10.1.2.0", "*******8000", ""}, ",") + "\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
@@ -0,0 +1,140 @@
+package csv
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// EnricherConfig is one entry of the per-api "api_enrichers" list in the
+// api maps file, e.g.
+//
+//	{"type": "ip_location", "input": ["ip"], "prefix": "x_"}
+//
+// Fields optionally selects which result keys are copied and renames
+// them; the output key is Prefix followed by the new name.
+type EnricherConfig struct {
+	Type   string                 `json:"type"`
+	Input  []string               `json:"input"`
+	Prefix string                 `json:"prefix"`
+	Fields map[string]string      `json:"fields"`
+	Args   map[string]interface{} `json:"args"`
+}
+
+// Enricher adds derived keys to a decoded log record before it is mapped
+// to csv columns. Enrichers of an api run in the configured order.
+type Enricher interface {
+	Init(en *CsvEncoder, conf *EnricherConfig) error
+	Enrich(jmap map[string]interface{}) error
+}
+
+var enricherFactories = make(map[string]func() Enricher)
+
+func RegisterEnricher(name string, factory func() Enricher) {
+	enricherFactories[name] = factory
+}
+
+type apiEnricher struct {
+	conf     EnricherConfig
+	enricher Enricher
+	// skip when one of these keys holds a string
+	unless []string
+}
+
+func (en *CsvEncoder) newEnricher(conf EnricherConfig) (*apiEnricher, error) {
+	factory, ok := enricherFactories[conf.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown enricher type: %s", conf.Type)
+	}
+	e := factory()
+	if err := e.Init(en, &conf); err != nil {
+		return nil, fmt.Errorf("enricher %s: %v", conf.Type, err)
+	}
+	return &apiEnricher{conf: conf, enricher: e}, nil
+}
+
+// loadEnrichers builds the per-api enrichers from "api_enrichers" and from
+// the older api_ip_location_map / api_phone_location_map entries. An api
+// listed in "api_enrichers" ignores the older maps. As before, an api in
+// both older maps only looks up the phone when the ip key is missing.
+func (en *CsvEncoder) loadEnrichers(m map[string]interface{}) error {
+	confs := make(map[string][]EnricherConfig)
+	legacy_ip := make(map[string][]string)
+
+	if v, ok := m["api_ip_location_map"]; ok {
+		ip_confs, err := ipLocationConfigs(v)
+		if err != nil {
+			return fmt.Errorf("api_ip_location_map: %v", err)
+		}
+		for api, c := range ip_confs {
+			confs[api] = append(confs[api], c...)
+			for _, conf := range c {
+				legacy_ip[api] = append(legacy_ip[api], conf.Input...)
+			}
+		}
+	}
+	if v, ok := m["api_phone_location_map"]; ok {
+		phone_confs, err := phoneLocationConfigs(v)
+		if err != nil {
+			return fmt.Errorf("api_phone_location_map: %v", err)
+		}
+		for api, c := range phone_confs {
+			confs[api] = append(confs[api], c...)
+		}
+	}
+
+	if v, ok := m["api_enrichers"]; ok {
+		api_confs := make(map[string][]EnricherConfig)
+		if err := decodeJson(v, &api_confs); err != nil {
+			return fmt.Errorf("api_enrichers: %v", err)
+		}
+		for api, c := range api_confs {
+			confs[api] = c
+			delete(legacy_ip, api)
+		}
+	}
+
+	en.api_enrichers = make(map[string][]*apiEnricher)
+	for api, c := range confs {
+		for _, conf := range c {
+			e, err := en.newEnricher(conf)
+			if err != nil {
+				return fmt.Errorf("%s: %v", api, err)
+			}
+			if conf.Type == "phone_location" {
+				e.unless = legacy_ip[api]
+			}
+			en.api_enrichers[api] = append(en.api_enrichers[api], e)
+		}
+	}
+	return nil
+}
+
+// decodeJson converts a generic json value into the given struct.
+func decodeJson(v interface{}, dst interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+func (en *CsvEncoder) enrich(jmap map[string]interface{}, api string) {
+	for _, e := range en.api_enrichers[api] {
+		if e.skip(jmap) {
+			continue
+		}
+		if err := e.enricher.Enrich(jmap); err != nil {
+			pipeline.LogError.Printf("%s: %s enricher: %v\n", api, e.conf.Type, err)
+		}
+	}
+}
+
+func (e *apiEnricher) skip(jmap map[string]interface{}) bool {
+	for _, key := range e.unless {
+		if _, ok := jmap[key].(string); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package csv
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PartitionFileOutput writes each encoded message to the file given by
+// path_template, filled from the ApiName, Bpid and LogAt fields:
+//
+//	{api} {bpid} {date} {year} {month} {day} {hour}
+//
+// Files are written as "<name>.tmp" and renamed with a "<name>.done"
+// marker when closed on rotation, idle timeout or shutdown.
+type PartitionFileOutput struct {
+	config *PartitionFileOutputConfig
+	files  map[string]*partFile
+}
+
+type PartitionFileOutputConfig struct {
+	BaseDir      string `toml:"base_dir"`
+	PathTemplate string `toml:"path_template"`
+	// Close a file over rotate_size bytes, open for rotate_interval
+	// seconds or not written for idle_timeout seconds.
+	RotateSize     int64 `toml:"rotate_size"`
+	RotateInterval int   `toml:"rotate_interval"`
+	IdleTimeout    int   `toml:"idle_timeout"`
+	MaxOpenFiles   int   `toml:"max_open_files"`
+	Gzip           bool  `toml:"gzip"`
+}
+
+type partFile struct {
+	name    string
+	tmp     string
+	f       *os.File
+	buf     *bufio.Writer
+	gz      *gzip.Writer
+	size    int64
+	opened  time.Time
+	written time.Time
+}
+
+func (fo *PartitionFileOutput) ConfigStruct() interface{} {
+	return &PartitionFileOutputConfig{
+		PathTemplate:   "{api}/{date}/{bpid}-{hour}.csv",
+		RotateSize:     256 << 20,
+		RotateInterval: 3600,
+		IdleTimeout:    600,
+		MaxOpenFiles:   256,
+	}
+}
+
+func (fo *PartitionFileOutput) Init(config interface{}) error {
+	fo.config = config.(*PartitionFileOutputConfig)
+
+	if len(fo.config.BaseDir) == 0 {
+		return fmt.Errorf("base_dir not set")
+	}
+	if len(fo.config.PathTemplate) == 0 {
+		return fmt.Errorf("path_template not set")
+	}
+	if err := os.MkdirAll(fo.config.BaseDir, 0755); err != nil {
+		return err
+	}
+	fo.files = make(map[string]*partFile)
+	return nil
+}
+
+func (fo *PartitionFileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder required")
+	}
+
+	var outBytes []byte
+	var e error
+
+	timer := time.NewTicker(10 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case pack, ok := <-or.InChan():
+			if !ok {
+				for key := range fo.files {
+					fo.closeFile(or, key)
+				}
+				return
+			}
+			if outBytes, e = or.Encode(pack); e != nil {
+				or.LogError(fmt.Errorf("Error encoding message: %s", e.Error()))
+			} else if outBytes != nil {
+				if e = fo.write(or, fo.packPath(pack), outBytes); e != nil {
+					or.LogError(e)
+				}
+			}
+			pack.Recycle()
+		case <-timer.C:
+			now := time.Now()
+			for key, pf := range fo.files {
+				if (fo.config.RotateInterval > 0 && now.Sub(pf.opened) >= time.Duration(fo.config.RotateInterval)*time.Second) ||
+					(fo.config.IdleTimeout > 0 && now.Sub(pf.written) >= time.Duration(fo.config.IdleTimeout)*time.Second) {
+					fo.closeFile(or, key)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (fo *PartitionFileOutput) packPath(pack *PipelinePack) string {
+	var bpid, api_name string
+	var log_at int64
+	for _, f := range pack.Message.GetFields() {
+		switch f.GetName() {
+		case "Bpid":
+			bpid, _ = f.GetValue().(string)
+		case "ApiName":
+			api_name, _ = f.GetValue().(string)
+		case "LogAt":
+			log_at, _ = f.GetValue().(int64)
+		}
+	}
+	t := time.Now()
+	if log_at > 0 {
+		t = time.Unix(log_at, 0)
+	}
+
+	r := strings.NewReplacer(
+		"{api}", pathSafe(api_name),
+		"{bpid}", pathSafe(bpid),
+		"{date}", t.Format("2006-01-02"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+	)
+	return filepath.Join(fo.config.BaseDir, filepath.Clean("/"+r.Replace(fo.config.PathTemplate)))
+}
+
+// maxPathPart leaves room in a 255 byte file name for the rest of the
+// template and the ".N", ".gz", ".tmp" and ".done" suffixes.
+const maxPathPart = 128
+
+// pathSafe makes a field value usable as part of a file name. Values over
+// maxPathPart bytes are cut, so files of long values sharing a prefix are
+// written together.
+func pathSafe(s string) string {
+	if len(s) == 0 {
+		return "unknown"
+	}
+	if len(s) > maxPathPart {
+		n := maxPathPart
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+	}
+	s = strings.Replace(s, "/", "_", -1)
+	s = strings.Replace(s, `\`, "_", -1)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+func (fo *PartitionFileOutput) write(or OutputRunner, key string, b []byte) error {
+	pf, ok := fo.files[key]
+	if !ok {
+		if fo.config.MaxOpenFiles > 0 && len(fo.files) >= fo.config.MaxOpenFiles {
+			fo.closeOldest(or)
+		}
+		var err error
+		if pf, err = fo.openFile(key); err != nil {
+			return err
+		}
+		fo.files[key] = pf
+	}
+
+	var err error
+	if pf.gz != nil {
+		_, err = pf.gz.Write(b)
+	} else {
+		_, err = pf.buf.Write(b)
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %v", pf.tmp, err)
+	}
+	pf.size += int64(len(b))
+	pf.written = time.Now()
+
+	if fo.config.RotateSize > 0 && pf.size >= fo.config.RotateSize {
+		fo.closeFile(or, key)
+	}
+	return nil
+}
+
+// openFile picks the first "<path>", "<path>.1", ... (number before the
+// extension) not used by a finished or open file.
+func (fo *PartitionFileOutput) openFile(key string) (*partFile, error) {
+	if err := os.MkdirAll(filepath.Dir(key), 0755); err != nil {
+		return nil, err
+	}
+
+	ext := filepath.Ext(key)
+	base := strings.TrimSuffix(key, ext)
+	if fo.config.Gzip {
+		ext += ".gz"
+	}
+	var name string
+	for seq := 0; ; seq++ {
+		name = base + ext
+		if seq > 0 {
+			name = base + "." + strconv.Itoa(seq) + ext
+		}
+		used, err := fileExists(name)
+		if err == nil && !used {
+			used, err = fileExists(name + ".tmp")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			break
+		}
+	}
+
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	pf := &partFile{
+		name:    name,
+		tmp:     name + ".tmp",
+		f:       f,
+		buf:     bufio.NewWriter(f),
+		opened:  now,
+		written: now,
+	}
+	if fo.config.Gzip {
+		pf.gz = gzip.NewWriter(pf.buf)
+	}
+	return pf, nil
+}
+
+func fileExists(name string) (bool, error) {
+	_, err := os.Stat(name)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (fo *PartitionFileOutput) closeOldest(or OutputRunner) {
+	var oldest string
+	var written time.Time
+	for key, pf := range fo.files {
+		if len(oldest) == 0 || pf.written.Before(written) {
+			oldest, written = key, pf.written
+		}
+	}
+	if len(oldest) > 0 {
+		fo.closeFile(or, oldest)
+	}
+}
+
+func (fo *PartitionFileOutput) closeFile(or OutputRunner, key string) {
+	pf, ok := fo.files[key]
+	if !ok {
+		return
+	}
+	delete(fo.files, key)
+
+	var err error
+	if pf.gz != nil {
+		err = pf.gz.Close()
+	}
+	if e := pf.buf.Flush(); err == nil {
+		err = e
+	}
+	if e := pf.f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("close %s: %v", pf.tmp, err))
+		return
+	}
+	if err = os.Rename(pf.tmp, pf.name); err != nil {
+		or.LogError(fmt.Errorf("rename %s: %v", pf.tmp, err))
+		return
+	}
+	done, err := os.Create(pf.name + ".done")
+	if err != nil {
+		or.LogError(fmt.Errorf("create done marker %s: %v", pf.name, err))
+		return
+	}
+	done.Close()
+}
+
+func init() {
+	RegisterPlugin("PartitionFileOutput", func() interface{} {
+		return new(PartitionFileOutput)
+	})
+}
@@ -0,0 +1,182 @@
+package csv
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// fakeOutputRunner records the errors an output logs.
+type fakeOutputRunner struct {
+	pipeline.OutputRunner
+
+	sync.Mutex
+	errors []error
+}
+
+func (or *fakeOutputRunner) LogError(err error) {
+	or.Lock()
+	or.errors = append(or.errors, err)
+	or.Unlock()
+}
+
+func (or *fakeOutputRunner) LogMessage(msg string) {}
+
+func newTestFileOutput(t *testing.T, setup func(*PartitionFileOutputConfig)) *PartitionFileOutput {
+	fo := new(PartitionFileOutput)
+	config := fo.ConfigStruct().(*PartitionFileOutputConfig)
+	config.BaseDir = t.TempDir()
+	if setup != nil {
+		setup(config)
+	}
+	if err := fo.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return fo
+}
+
+func readFile(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPartitionFileRotation(t *testing.T) {
+	fo := newTestFileOutput(t, func(config *PartitionFileOutputConfig) {
+		config.RotateSize = 8
+	})
+	or := new(fakeOutputRunner)
+	key := filepath.Join(fo.config.BaseDir, "user_login", "b1-03.csv")
+
+	if err := fo.write(or, key, []byte("a,b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(key + ".tmp"); err != nil {
+		t.Errorf("open file not written as .tmp: %v", err)
+	}
+	if _, err := os.Stat(key); !os.IsNotExist(err) {
+		t.Errorf("open file visible under its final name: %v", err)
+	}
+
+	// reaches rotate_size, so it is closed and the next write opens b1-03.1.csv
+	for _, line := range []string{"c,d\n", "e,f\n"} {
+		if err := fo.write(or, key, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, key); got != "a,b\nc,d\n" {
+		t.Errorf("got first file %q", got)
+	}
+	if _, err := os.Stat(key + ".done"); err != nil {
+		t.Errorf("no done marker for the rotated file: %v", err)
+	}
+
+	second := filepath.Join(fo.config.BaseDir, "user_login", "b1-03.1.csv")
+	fo.closeFile(or, key)
+	if got := readFile(t, second); got != "e,f\n" {
+		t.Errorf("got second file %q", got)
+	}
+	if _, err := os.Stat(second + ".done"); err != nil {
+		t.Errorf("no done marker for the closed file: %v", err)
+	}
+	if _, err := os.Stat(second + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("tmp file left after close: %v", err)
+	}
+	if len(or.errors) > 0 {
+		t.Errorf("got errors: %v", or.errors)
+	}
+}
+
+func TestPartitionFileGzip(t *testing.T) {
+	fo := newTestFileOutput(t, func(config *PartitionFileOutputConfig) {
+		config.Gzip = true
+	})
+	or := new(fakeOutputRunner)
+	key := filepath.Join(fo.config.BaseDir, "b1.csv")
+
+	for _, line := range []string{"a,b\n", "c,d\n"} {
+		if err := fo.write(or, key, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fo.closeFile(or, key)
+
+	f, err := os.Open(key + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a,b\nc,d\n" {
+		t.Errorf("got %q", b)
+	}
+	if _, err := os.Stat(key + ".gz.done"); err != nil {
+		t.Errorf("no done marker: %v", err)
+	}
+}
+
+func TestPartitionFilePath(t *testing.T) {
+	fo := newTestFileOutput(t, nil)
+	pack := pipeline.NewPipelinePack(nil)
+	log_at := time.Date(2016, 1, 2, 3, 4, 5, 0, time.Local).Unix()
+	for _, kv := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"Bpid", "../" + strings.Repeat("é", 200)},
+		{"ApiName", "user/login"},
+		{"LogAt", log_at},
+	} {
+		f, err := message.NewField(kv.name, kv.value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pack.Message.AddField(f)
+	}
+
+	path := fo.packPath(pack)
+	dir, file := filepath.Split(path)
+	if want := filepath.Join(fo.config.BaseDir, "user_login", "2016-01-02") + "/"; dir != want {
+		t.Errorf("got dir %q, want %q", dir, want)
+	}
+	bpid := strings.TrimSuffix(file, "-03.csv")
+	if len(bpid) > maxPathPart || !strings.HasPrefix(bpid, ".._é") || strings.HasSuffix(bpid, "\xc3") {
+		t.Errorf("got bpid part %q of %d bytes", bpid, len(bpid))
+	}
+}
+
+func TestPartitionFileNameError(t *testing.T) {
+	fo := newTestFileOutput(t, nil)
+	or := new(fakeOutputRunner)
+	key := filepath.Join(fo.config.BaseDir, strings.Repeat("b", 300)+".csv")
+
+	done := make(chan error)
+	go func() {
+		done <- fo.write(or, key, []byte("a,b\n"))
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got no error for a file name over the limit")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("openFile did not return")
+	}
+}
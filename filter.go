@@ -5,6 +5,7 @@ import (
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,12 +18,72 @@ type BylogFilter struct {
 	pid      int
 	fr       FilterRunner
 	h        PluginHelper
+	prom     *PromCounter
+	sender   *MetricSender
+	dims     []dimension
+	alerter  *Alerter
+	// buckets starting before are partial and not alerted on
+	alert_since int64
+	// parse JsonString for uid_field or a json dimension
+	need_json bool
+	// counter version written to state_file last
+	saved_version int64
 }
 
 type BylogFilterConfig struct {
 	MetricInterval int    `toml:"metric_interval"`
 	OutputFormat   string `toml:"output_format"`
 	SendNullMetric bool   `toml:"send_null_metric"`
+	// bucket_by "receive" counts by the hour a message is received in,
+	// "log_at" by its LogAt field in buckets of bucket_interval seconds,
+	// each flushed lateness_grace seconds after it ends.
+	BucketBy       string `toml:"bucket_by"`
+	BucketInterval int64  `toml:"bucket_interval"`
+	LatenessGrace  int64  `toml:"lateness_grace"`
+	// Put before each json record, {clock} is replaced by the unix time.
+	// Empty for none.
+	JsonPrefix string `toml:"json_prefix"`
+	// Serve cumulative counts on http://<prometheus_addr>/metrics.
+	PrometheusAddr string `toml:"prometheus_addr"`
+	// Path prefix of the graphite and statsd formats.
+	MetricPrefix string `toml:"metric_prefix"`
+	// Send points to "udp://host:port" or "tcp://host:port" instead of
+	// injecting them.
+	MetricAddr string `toml:"metric_addr"`
+	// Estimate distinct values of this JsonString field (e.g. "uid", or
+	// "user.id" for a nested one) per key with a HyperLogLog of
+	// 2^uid_precision registers. uid_sketch also outputs the sketch in
+	// base64 so buckets can be merged downstream. With state_file each
+	// saved key carries its sketch, about 4/3 * 2^uid_precision bytes:
+	// 5.5 KB at the default 12, or 55 MB per save at 10000 keys.
+	UidField     string `toml:"uid_field"`
+	UidPrecision int    `toml:"uid_precision"`
+	UidSketch    bool   `toml:"uid_sketch"`
+	// Fields the counts are grouped by, in output order: message fields,
+	// "Hostname", or "json:<path>" into JsonString. Past max_keys
+	// distinct dimension values in the counter, new ones are counted with
+	// every dimension set to "_other".
+	Dimensions []string `toml:"dimensions"`
+	MaxKeys    int      `toml:"max_keys"`
+	// Alert when the count of a key in a finished bucket falls under
+	// alert_min_ratio of its alert_baseline, "same_hour" or "ewma", or
+	// its error ratio exceeds alert_error_ratio (0 for none). Keys with a
+	// baseline or count under alert_min_count are ignored. Empty
+	// alert_baseline for no alerts.
+	AlertBaseline   string  `toml:"alert_baseline"`
+	AlertDays       int     `toml:"alert_days"`
+	AlertEwmaAlpha  float64 `toml:"alert_ewma_alpha"`
+	AlertMinRatio   float64 `toml:"alert_min_ratio"`
+	AlertErrorRatio float64 `toml:"alert_error_ratio"`
+	AlertMinCount   int64   `toml:"alert_min_count"`
+	AlertStateFile  string  `toml:"alert_state_file"`
+	// Save the counters to state_file every state_interval seconds, after
+	// each flush that delivered counts and on shutdown instead of flushing
+	// partial counts, and merge them back on start. Saves are skipped while
+	// the counters are unchanged. A save encodes every key on the Run
+	// goroutine, see uid_field for its size.
+	StateFile     string `toml:"state_file"`
+	StateInterval int    `toml:"state_interval"`
 }
 
 type MetricType int
@@ -36,91 +97,250 @@ const (
 	MTypeMaxNum         MetricType = 5
 )
 
+var metricTypeNames = []string{"in", "delay", "timeerr", "jsonerr", "othererr"}
+
 type Key struct {
-	bpid, api string
+	bucket int64
+	dims   string
 }
 
 type Value struct {
 	counts []int
+	bytes  int64
+	lag    *LagStats
+	uids   *HyperLogLog
+}
+
+func (f *BylogFilter) newValue() Value {
+	v := Value{counts: make([]int, MTypeMaxNum), lag: NewLagStats()}
+	if len(f.config.UidField) > 0 {
+		v.uids, _ = NewHyperLogLog(f.config.UidPrecision)
+	}
+	return v
 }
 
 type Counter struct {
 	sync.RWMutex
 	m map[Key]Value
+	// number of keys by dims, for max_keys
+	dims map[string]int
+	// start of the hour counts by receive time belong to, set by flushes
+	hour int64
+	// bumped on every change, so unchanged counters are not saved again
+	version int64
+}
+
+func (c *Counter) reset() {
+	c.m = make(map[Key]Value)
+	c.dims = make(map[string]int)
+	c.version++
+}
+
+func (c *Counter) set(k Key, v Value) {
+	if _, ok := c.m[k]; !ok {
+		c.dims[k.dims]++
+	}
+	c.m[k] = v
+	c.version++
+}
+
+func (c *Counter) remove(k Key) {
+	if _, ok := c.m[k]; !ok {
+		return
+	}
+	delete(c.m, k)
+	c.version++
+	if c.dims[k.dims]--; c.dims[k.dims] <= 0 {
+		delete(c.dims, k.dims)
+	}
 }
 
 func (this *BylogFilter) ConfigStruct() interface{} {
-	return &BylogFilterConfig{}
+	return &BylogFilterConfig{
+		BucketBy:       "receive",
+		BucketInterval: 3600,
+		LatenessGrace:  600,
+		JsonPrefix:     "BBBEEEE000001111112222222FFFFFFF|{clock}|bylog_metrics\t",
+		MetricPrefix:   "bylog",
+		UidPrecision:   12,
+		Dimensions:     []string{"Bpid", "ApiName"},
+		MaxKeys:        10000,
+		AlertDays:      7,
+		AlertEwmaAlpha: 0.3,
+		AlertMinRatio:  0.5,
+		AlertMinCount:  100,
+		StateInterval:  60,
+	}
 }
 
 func (this *BylogFilter) Init(config interface{}) error {
 	this.config = config.(*BylogFilterConfig)
 
 	switch this.config.OutputFormat {
-	case "csv", "json":
+	case "csv", "json", "graphite", "statsd":
 		LogInfo.Println("Output format is", this.config.OutputFormat)
 	default:
-		return fmt.Errorf("Output format must be csv or json")
+		return fmt.Errorf("Output format must be csv, json, graphite or statsd")
+	}
+	if len(this.config.MetricAddr) > 0 {
+		var err error
+		if this.sender, err = NewMetricSender(this.config.MetricAddr); err != nil {
+			return err
+		}
+	}
+	switch this.config.BucketBy {
+	case "receive":
+	case "log_at":
+		if this.config.BucketInterval <= 0 {
+			return fmt.Errorf("bucket_interval must be positive")
+		}
+	default:
+		return fmt.Errorf("bucket_by must be receive or log_at")
 	}
 
-	this.counter.m = make(map[Key]Value)
-	this.hostname, _ = os.Hostname()
-	this.pid = os.Getpid()
+	if len(this.config.UidField) > 0 {
+		if _, err := NewHyperLogLog(this.config.UidPrecision); err != nil {
+			return err
+		}
+	}
 
-	go func() {
-		var timer *time.Ticker
-		for {
-			now := time.Now()
-			truncated := now.Add(time.Duration(1) * time.Hour).Truncate(time.Hour)
+	var err error
+	if this.dims, err = parseDimensions(this.config.Dimensions); err != nil {
+		return err
+	}
+	this.need_json = len(this.config.UidField) > 0
+	labels := make([]string, len(this.dims))
+	for i, d := range this.dims {
+		labels[i] = d.label
+		this.need_json = this.need_json || d.json
+	}
 
-			var sleep time.Duration
-			if this.config.MetricInterval == 0 {
-				sleep = truncated.Sub(now)
-			} else {
-				sleep = time.Duration(this.config.MetricInterval) * time.Second
-			}
-			timer = time.NewTicker(sleep)
-			LogInfo.Printf("Now is %s, going to sleep %s\n", now.String(), sleep.String())
+	if len(this.config.AlertBaseline) > 0 {
+		if this.config.BucketBy == "receive" && this.config.MetricInterval != 0 {
+			return fmt.Errorf("alert_baseline needs hourly flushes, metric_interval must be 0")
+		}
+		if this.alerter, err = NewAlerter(this.config); err != nil {
+			return err
+		}
+		this.alert_since = time.Now().Unix()
+	}
 
-			select {
-			case <-timer.C:
-				this.cleanMetricCounter(false)
-			}
-			timer.Stop()
+	this.counter.reset()
+	this.counter.hour = time.Now().Truncate(time.Hour).Unix()
+	if this.prom != nil {
+		this.prom.Close()
+		this.prom = nil
+	}
+	if len(this.config.PrometheusAddr) > 0 {
+		this.prom = NewPromCounter(labels, this.config.MaxKeys)
+		if err := this.prom.Serve(this.config.PrometheusAddr); err != nil {
+			return err
 		}
-	}()
+	}
+	this.hostname, _ = os.Hostname()
+	this.pid = os.Getpid()
 
 	return nil
 }
 
+// Run counts the messages and flushes the counters in one goroutine, so
+// fr and h are only used once set.
 func (this *BylogFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	this.fr = fr
 	this.h = h
+	if this.prom != nil {
+		defer this.prom.Close()
+	}
+
+	if len(this.config.StateFile) > 0 {
+		if err = this.restoreState(); err != nil {
+			return err
+		}
+	}
+
+	timer := time.NewTimer(this.flushSleep())
+	defer timer.Stop()
+	var save <-chan time.Time
+	if len(this.config.StateFile) > 0 && this.config.StateInterval > 0 {
+		ticker := time.NewTicker(time.Duration(this.config.StateInterval) * time.Second)
+		defer ticker.Stop()
+		save = ticker.C
+	}
 
-	var pack *PipelinePack
 	inChan := fr.InChan()
-	for pack = range inChan {
-		fields := pack.Message.GetFields()
-
-		var metric_type int64
-		var bpid, api_name string
-		for _, f := range fields {
-			switch f.GetName() {
-			case "Bpid":
-				bpid = f.GetValue().(string)
-			case "ApiName":
-				api_name = f.GetValue().(string)
-			case "Error":
-				metric_type = f.GetValue().(int64)
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				if len(this.config.StateFile) > 0 {
+					this.saveState()
+				} else {
+					this.cleanMetricCounter(true)
+				}
+				return
 			}
+			this.countPack(pack)
+			pack.Recycle()
+		case <-timer.C:
+			this.cleanMetricCounter(false)
+			timer.Reset(this.flushSleep())
+		case <-save:
+			this.saveState()
 		}
+	}
+}
+
+// flushSleep returns the time to the next flush: metric_interval, a minute
+// for log_at buckets, or the next hour.
+func (this *BylogFilter) flushSleep() time.Duration {
+	now := time.Now()
+	truncated := now.Add(time.Duration(1) * time.Hour).Truncate(time.Hour)
 
-		this.doMetric(bpid, api_name, MetricType(metric_type))
-		pack.Recycle()
+	var sleep time.Duration
+	if this.config.MetricInterval != 0 {
+		sleep = time.Duration(this.config.MetricInterval) * time.Second
+	} else if this.config.BucketBy == "log_at" {
+		sleep = time.Minute
+	} else {
+		sleep = truncated.Sub(now)
+	}
+	LogInfo.Printf("Now is %s, going to sleep %s\n", now.String(), sleep.String())
+	return sleep
+}
+
+func (this *BylogFilter) countPack(pack *PipelinePack) {
+	var metric_type, log_at int64
+	var size int
+	var uid string
+	var jdata map[string]interface{}
+	for _, f := range pack.Message.GetFields() {
+		switch f.GetName() {
+		case "Error":
+			metric_type = f.GetValue().(int64)
+		case "LogAt":
+			log_at = f.GetValue().(int64)
+		case "JsonString":
+			json_string := f.GetValue().(string)
+			size = len(json_string)
+			if this.need_json {
+				jdata = make(map[string]interface{})
+				json.Unmarshal([]byte(json_string), &jdata)
+			}
+		}
+	}
+	if len(this.config.UidField) > 0 {
+		uid = jsonPathString(jdata, this.config.UidField)
+	}
+	values := make([]string, len(this.dims))
+	for i, d := range this.dims {
+		if d.json {
+			values[i] = jsonPathString(jdata, d.name)
+		} else {
+			values[i] = messageFieldString(pack.Message, d.name)
+		}
 	}
 
-	this.cleanMetricCounter(true)
-	return
+	this.doMetric(dimKey(values), log_at, size, uid, MetricType(metric_type))
 }
 
 func init() {
@@ -129,94 +349,297 @@ func init() {
 	})
 }
 
-func (f *BylogFilter) doMetric(bpid, api string, t MetricType) {
+// bucket returns the start of the bucket a message is counted in, always
+// 0 when bucketing by receive time. Messages without a usable LogAt go to
+// the current bucket.
+func (f *BylogFilter) bucket(log_at int64, t MetricType) int64 {
+	if f.config.BucketBy != "log_at" {
+		return 0
+	}
+	if log_at <= 0 || t == MTypeDropTimeError {
+		log_at = time.Now().Unix()
+	}
+	return log_at - log_at%f.config.BucketInterval
+}
+
+func (f *BylogFilter) doMetric(dims string, log_at int64, size int, uid string, t MetricType) {
 	if t >= MTypeMaxNum {
 		return
 	}
 
+	if f.prom != nil {
+		f.prom.Inc(dims, t)
+	}
+
+	k := Key{f.bucket(log_at, t), dims}
 	f.counter.Lock()
-	if v, ok := f.counter.m[Key{bpid, api}]; ok {
-		v.counts[t]++
-		f.counter.m[Key{bpid, api}] = v
-	} else {
-		new_value := Value{make([]int, MTypeMaxNum)}
-		new_value.counts[t]++
-		f.counter.m[Key{bpid, api}] = new_value
+	v, ok := f.counter.m[k]
+	if !ok && f.config.MaxKeys > 0 && f.counter.dims[k.dims] == 0 && len(f.counter.dims) >= f.config.MaxKeys {
+		k.dims = otherDims(len(f.dims))
+		v, ok = f.counter.m[k]
+	}
+	if !ok {
+		v = f.newValue()
 	}
+	v.counts[t]++
+	v.bytes += int64(size)
+	// a time error LogAt is out of range, its lag would be garbage
+	if log_at > 0 && t != MTypeDropTimeError {
+		v.lag.Add(time.Now().Unix() - log_at)
+	}
+	if v.uids != nil && len(uid) > 0 {
+		v.uids.Add(uid)
+	}
+	f.counter.set(k, v)
 	f.counter.Unlock()
 }
 
+// cleanMetricCounter delivers and removes the finished buckets, or all of
+// them when exiting. Buckets by receive time are always finished. They are
+// taken out of the counter under the lock and delivered after it.
 func (f *BylogFilter) cleanMetricCounter(exiting bool) {
 	num := 0
+	now := time.Now()
+
+	var flushed map[Key]Value
 	f.counter.Lock()
-	for k, v := range f.counter.m {
-		d, _ := time.ParseDuration("-1h")
-		t := time.Now().Add(d)
-		if exiting == true {
-			t = time.Now()
-		}
-
-		var point string
-		if f.config.OutputFormat == "json" {
-			type M struct {
-				Lts_at  int64  `json:"lts_at"`
-				Time    string `json:"time"`
-				MBpid   string `json:"mbpid"`
-				MApi    string `json:"mapi"`
-				Host    string `json:"host"`
-				CountIn string `json:"count_in"`
-			}
-			clock := time.Now().Unix()
-			m := M{
-				Lts_at:  clock,
-				Time:    t.Truncate(time.Hour).Format("2006-01-02 15:04:05.999999999"),
-				MBpid:   k.bpid,
-				MApi:    k.api,
-				Host:    fmt.Sprintf("%s:%d", f.hostname, f.pid),
-				CountIn: fmt.Sprintf("%d", v.counts[MTypeOK]),
-			}
-			jstr, err := json.Marshal(m)
-			if err != nil {
-				f.fr.LogError(err)
-				continue
+	if exiting || f.config.BucketBy != "log_at" {
+		flushed = f.counter.m
+		f.counter.reset()
+		f.counter.hour = now.Truncate(time.Hour).Unix()
+	} else {
+		flushed = make(map[Key]Value)
+		for k, v := range f.counter.m {
+			if now.Unix() >= k.bucket+f.config.BucketInterval+f.config.LatenessGrace {
+				flushed[k] = v
+				f.counter.remove(k)
 			}
+		}
+	}
+	if f.config.SendNullMetric == true {
+		k := Key{f.bucket(now.Unix(), MTypeOK), dimKey(make([]string, len(f.dims)))}
+		if _, ok := f.counter.m[k]; !ok {
+			f.counter.set(k, f.newValue())
+		}
+	}
+	f.counter.Unlock()
 
-			point = fmt.Sprintf("%s|%d|%s\t%s", "BBBEEEE000001111112222222FFFFFFF", clock, "bylog_metrics", jstr)
+	finished := make(map[int64]map[string][]int)
+	var points []string
+	for k, v := range flushed {
+		var t, end time.Time
+		if f.config.BucketBy == "log_at" {
+			t = time.Unix(k.bucket, 0)
+			end = t.Add(time.Duration(f.config.BucketInterval) * time.Second)
 		} else {
-			var arr []string
-			arr = append(arr, t.Truncate(time.Hour).Format("2006-01-02 15:04:05.999999999"))
-			arr = append(arr, k.bpid)
-			arr = append(arr, k.api)
-			arr = append(arr, fmt.Sprintf("%s:%d", f.hostname, f.pid))
-			for _, count := range v.counts {
-				arr = append(arr, fmt.Sprintf("%d", count))
+			d, _ := time.ParseDuration("-1h")
+			t = now.Add(d)
+			if exiting == true {
+				t = now
 			}
-			point = strings.Join(arr, ",")
+			t = t.Truncate(time.Hour)
+			end = t.Add(time.Hour)
+		}
+		if _, ok := finished[t.Unix()]; !ok {
+			finished[t.Unix()] = make(map[string][]int)
+		}
+		finished[t.Unix()][k.dims] = v.counts
+
+		point, err := f.formatPoint(k, v, t, end)
+		if err != nil {
+			f.fr.LogError(err)
+			continue
 		}
 
 		num++
-		f.deliverMetric(point + "\n")
+		points = append(points, point+"\n")
 	}
-	f.counter.m = make(map[Key]Value)
-	if f.config.SendNullMetric == true {
-		new_value := Value{make([]int, MTypeMaxNum)}
-		f.counter.m[Key{"", ""}] = new_value
+	f.deliverMetrics(points)
+	if f.alerter != nil && !exiting {
+		f.checkAlerts(now, finished)
+	}
+	if len(flushed) > 0 {
+		f.saveState()
 	}
-	f.counter.Unlock()
 
 	LogInfo.Println("This hour: num of points in counter:", num)
 }
 
-func (f *BylogFilter) deliverMetric(point string) {
+// formatPoint renders the counts of one key for the bucket [t, end). The
+// graphite and statsd formats give one line per metric type.
+func (f *BylogFilter) formatPoint(k Key, v Value, t, end time.Time) (string, error) {
+	values := splitDims(k.dims)
+	switch f.config.OutputFormat {
+	case "graphite", "statsd":
+		var lines []string
+		for i, count := range v.counts {
+			path := metricPath(append(values, metricTypeNames[i])...)
+			if len(f.config.MetricPrefix) > 0 {
+				path = f.config.MetricPrefix + "." + path
+			}
+			if f.config.OutputFormat == "graphite" {
+				lines = append(lines, fmt.Sprintf("%s %d %d", path, count, t.Unix()))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s:%d|c", path, count))
+			}
+		}
+		if v.uids != nil {
+			path := metricPath(append(values, "uids")...)
+			if len(f.config.MetricPrefix) > 0 {
+				path = f.config.MetricPrefix + "." + path
+			}
+			if f.config.OutputFormat == "graphite" {
+				lines = append(lines, fmt.Sprintf("%s %d %d", path, v.uids.Count(), t.Unix()))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s:%d|g", path, v.uids.Count()))
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if f.config.OutputFormat == "json" {
+		type M struct {
+			Lts_at        int64             `json:"lts_at"`
+			Time          string            `json:"time"`
+			StartAt       int64             `json:"start_at"`
+			EndAt         int64             `json:"end_at"`
+			MBpid         string            `json:"mbpid"`
+			MApi          string            `json:"mapi"`
+			Dims          map[string]string `json:"dims,omitempty"`
+			Host          string            `json:"host"`
+			CountIn       string            `json:"count_in"`
+			CountDelay    string            `json:"count_delay"`
+			CountTimeErr  string            `json:"count_timeerr"`
+			CountJsonErr  string            `json:"count_jsonerr"`
+			CountOtherErr string            `json:"count_othererr"`
+			Bytes         string            `json:"bytes"`
+			LagMin        string            `json:"lag_min"`
+			LagAvg        string            `json:"lag_avg"`
+			LagMax        string            `json:"lag_max"`
+			LagP50        string            `json:"lag_p50"`
+			LagP95        string            `json:"lag_p95"`
+			LagP99        string            `json:"lag_p99"`
+			Uids          string            `json:"uids,omitempty"`
+			UidSketch     string            `json:"uid_sketch,omitempty"`
+		}
+		clock := time.Now().Unix()
+		m := M{
+			Lts_at:        clock,
+			Time:          t.Format("2006-01-02 15:04:05.999999999"),
+			StartAt:       t.Unix(),
+			EndAt:         end.Unix(),
+			Host:          fmt.Sprintf("%s:%d", f.hostname, f.pid),
+			CountIn:       fmt.Sprintf("%d", v.counts[MTypeOK]),
+			CountDelay:    fmt.Sprintf("%d", v.counts[MTypeDelay]),
+			CountTimeErr:  fmt.Sprintf("%d", v.counts[MTypeDropTimeError]),
+			CountJsonErr:  fmt.Sprintf("%d", v.counts[MTypeDropJsonError]),
+			CountOtherErr: fmt.Sprintf("%d", v.counts[MTypeDropOtherError]),
+			Bytes:         fmt.Sprintf("%d", v.bytes),
+			LagMin:        fmt.Sprintf("%d", v.lag.min),
+			LagAvg:        fmt.Sprintf("%.2f", v.lag.Avg()),
+			LagMax:        fmt.Sprintf("%d", v.lag.max),
+			LagP50:        fmt.Sprintf("%d", v.lag.Quantile(0.50)),
+			LagP95:        fmt.Sprintf("%d", v.lag.Quantile(0.95)),
+			LagP99:        fmt.Sprintf("%d", v.lag.Quantile(0.99)),
+		}
+		for i, d := range f.dims {
+			switch d.label {
+			case "bpid":
+				m.MBpid = values[i]
+			case "api":
+				m.MApi = values[i]
+			default:
+				if m.Dims == nil {
+					m.Dims = make(map[string]string)
+				}
+				m.Dims[d.label] = values[i]
+			}
+		}
+		if v.uids != nil {
+			m.Uids = fmt.Sprintf("%d", v.uids.Count())
+			if f.config.UidSketch {
+				m.UidSketch = v.uids.String()
+			}
+		}
+		jstr, err := json.Marshal(m)
+		if err != nil {
+			return "", err
+		}
+
+		prefix := strings.Replace(f.config.JsonPrefix, "{clock}", fmt.Sprintf("%d", clock), -1)
+		return prefix + string(jstr), nil
+	}
+
+	var arr []string
+	arr = append(arr, t.Format("2006-01-02 15:04:05.999999999"))
+	for _, value := range values {
+		arr = append(arr, csvSafe(value))
+	}
+	arr = append(arr, fmt.Sprintf("%s:%d", f.hostname, f.pid))
+	for _, count := range v.counts {
+		arr = append(arr, fmt.Sprintf("%d", count))
+	}
+	arr = append(arr, fmt.Sprintf("%d", v.bytes))
+	arr = append(arr, fmt.Sprintf("%d", v.lag.min))
+	arr = append(arr, fmt.Sprintf("%.2f", v.lag.Avg()))
+	arr = append(arr, fmt.Sprintf("%d", v.lag.max))
+	arr = append(arr, fmt.Sprintf("%d", v.lag.Quantile(0.50)))
+	arr = append(arr, fmt.Sprintf("%d", v.lag.Quantile(0.95)))
+	arr = append(arr, fmt.Sprintf("%d", v.lag.Quantile(0.99)))
+	if v.uids != nil {
+		arr = append(arr, fmt.Sprintf("%d", v.uids.Count()))
+		if f.config.UidSketch {
+			arr = append(arr, v.uids.String())
+		}
+	}
+	return strings.Join(arr, ","), nil
+}
+
+// deliverMetrics sends the points of one flush to metric_addr together, or
+// injects a message for each point.
+func (f *BylogFilter) deliverMetrics(points []string) {
 	const msgType = "BylogMetrics"
 
-	pack := f.h.PipelinePack(0)
-	if pack == nil {
-		LogError.Println("exceeded MaxMsgLoops =", f.h.PipelineConfig().Globals.MaxMsgLoops)
+	if f.sender != nil {
+		if err := f.sender.SendLines(points); err != nil {
+			LogError.Println("send metric fail:", err)
+		}
 		return
 	}
-	pack.Message.SetLogger(f.fr.Name())
-	pack.Message.SetType(msgType)
-	pack.Message.SetPayload(point)
-	f.fr.Inject(pack)
+
+	for _, point := range points {
+		pack := f.h.PipelinePack(0)
+		if pack == nil {
+			LogError.Println("exceeded MaxMsgLoops =", f.h.PipelineConfig().Globals.MaxMsgLoops)
+			return
+		}
+		pack.Message.SetLogger(f.fr.Name())
+		pack.Message.SetType(msgType)
+		pack.Message.SetPayload(point)
+		f.fr.Inject(pack)
+	}
+}
+
+// jsonPathString returns the field at a dotted path of a json object as a
+// string, or "" when it is missing or not a scalar.
+func jsonPathString(jdata map[string]interface{}, path string) string {
+	var value interface{} = jdata
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = obj[part]; !ok {
+			return ""
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
 }
@@ -0,0 +1,384 @@
+package csv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func newTestFilter(t *testing.T, setup func(*BylogFilterConfig)) *BylogFilter {
+	pipeline.LogInfo = log.New(ioutil.Discard, "", 0)
+	pipeline.LogError = log.New(ioutil.Discard, "", 0)
+
+	f := new(BylogFilter)
+	config := f.ConfigStruct().(*BylogFilterConfig)
+	config.OutputFormat = "csv"
+	if setup != nil {
+		setup(config)
+	}
+	if err := f.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFormatPointCsvDimensions(t *testing.T) {
+	f := newTestFilter(t, func(config *BylogFilterConfig) {
+		config.Dimensions = []string{"Bpid", "json:geo.country"}
+	})
+
+	v := f.newValue()
+	v.counts[MTypeOK] = 3
+	k := Key{0, dimKey([]string{"b1", "Korea, Republic of\nSouth"})}
+	start := time.Unix(1451703600, 0)
+	point, err := f.formatPoint(k, v, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.ContainsAny(point, "\r\n") {
+		t.Fatalf("csv point has a line break: %q", point)
+	}
+	fields := strings.Split(point, ",")
+	if fields[1] != "b1" || fields[2] != "Korea_ Republic of_South" {
+		t.Errorf("got dimensions %q, %q", fields[1], fields[2])
+	}
+	if fields[4] != "3" {
+		t.Errorf("got count_in %q at column 4 of %q", fields[4], point)
+	}
+}
+
+func TestMaxKeysCountsDistinctDimensions(t *testing.T) {
+	f := newTestFilter(t, func(config *BylogFilterConfig) {
+		config.BucketBy = "log_at"
+		config.MaxKeys = 2
+	})
+
+	now := time.Now().Unix()
+	a := dimKey([]string{"b1", "user_login"})
+	b := dimKey([]string{"b2", "user_login"})
+	for _, log_at := range []int64{now, now - 3600, now - 7200} {
+		f.doMetric(a, log_at, 0, "", MTypeOK)
+		f.doMetric(b, log_at, 0, "", MTypeOK)
+	}
+	f.doMetric(dimKey([]string{"b3", "user_login"}), now, 0, "", MTypeOK)
+
+	other := otherDims(2)
+	totals := make(map[string]int)
+	for k, v := range f.counter.m {
+		totals[k.dims] += v.counts[MTypeOK]
+	}
+	if totals[a] != 3 || totals[b] != 3 || totals[other] != 1 {
+		t.Errorf("got counts %v, want 3 for each of two dimensions and 1 for _other", totals)
+	}
+}
+
+func TestLagSkipsTimeErrors(t *testing.T) {
+	f := newTestFilter(t, nil)
+	dims := dimKey([]string{"b1", "user_login"})
+	now := time.Now().Unix()
+	f.doMetric(dims, now-10, 0, "", MTypeOK)
+	f.doMetric(dims, now-90*86400, 0, "", MTypeDropTimeError)
+
+	v := f.counter.m[Key{0, dims}]
+	if v.lag.n != 1 || v.lag.max > 60 {
+		t.Errorf("got %d lag samples up to %d, want only the message without a time error", v.lag.n, v.lag.max)
+	}
+	if v.counts[MTypeDropTimeError] != 1 {
+		t.Errorf("time error not counted: %v", v.counts)
+	}
+}
+
+func TestDimensionLabels(t *testing.T) {
+	dims, err := parseDimensions([]string{"Bpid", "ApiName", "json:client-version", "json:geo.country", "json:2fa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bpid", "api", "client_version", "geo_country", "_2fa"}
+	for i, d := range dims {
+		if d.label != want[i] {
+			t.Errorf("dimension %d: got label %q, want %q", i, d.label, want[i])
+		}
+	}
+
+	for _, names := range [][]string{{"Type"}, {"json:type"}, {"Bpid", "json:bpid"}} {
+		if _, err := parseDimensions(names); err == nil {
+			t.Errorf("%v: got no error", names)
+		}
+	}
+}
+
+func TestAlertsSkipPartialHour(t *testing.T) {
+	pipeline.LogInfo = log.New(ioutil.Discard, "", 0)
+	f := new(BylogFilter)
+	config := f.ConfigStruct().(*BylogFilterConfig)
+	config.OutputFormat = "csv"
+	config.AlertBaseline = "ewma"
+	config.MetricInterval = 60
+	if err := f.Init(config); err == nil {
+		t.Error("got no error for alerts with metric_interval")
+	}
+
+	f = newTestFilter(t, func(config *BylogFilterConfig) {
+		config.AlertBaseline = "ewma"
+	})
+	now := time.Now()
+	hour := now.Add(-time.Hour).Truncate(time.Hour).Unix()
+	f.alert_since = hour + 1800
+	f.checkAlerts(now, map[int64]map[string][]int{hour: {dimKey([]string{"b1", "user_login"}): {10, 0, 0, 0, 0}}})
+	if f.alerter.Last() != 0 {
+		t.Errorf("checked the partial hour %d", f.alerter.Last())
+	}
+
+	f.alert_since = hour
+	f.checkAlerts(now, nil)
+	if f.alerter.Last() != hour {
+		t.Errorf("got last checked hour %d, want %d", f.alerter.Last(), hour)
+	}
+}
+
+func TestStateKeepsHourOfLastFlush(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state_file := filepath.Join(t.TempDir(), "bylog.state")
+	setup := func(config *BylogFilterConfig) {
+		config.StateFile = state_file
+		config.MetricAddr = "udp://" + conn.LocalAddr().String()
+	}
+
+	// saved after the hour ended but before its flush
+	f := newTestFilter(t, setup)
+	last_hour := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	f.counter.hour = last_hour.Unix()
+	f.doMetric(dimKey([]string{"b1", "user_login"}), 0, 0, "", MTypeOK)
+	f.saveState()
+
+	g := newTestFilter(t, setup)
+	if err = g.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.counter.m) != 0 {
+		t.Errorf("merged %d counters of the last hour into this one", len(g.counter.m))
+	}
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := last_hour.Format("2006-01-02 15:04:05") + ",b1,user_login,"; !strings.HasPrefix(string(buf[:n]), want) {
+		t.Errorf("got point %q, want it to start with %q", buf[:n], want)
+	}
+}
+
+func TestPrometheusClosedWithRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	setup := func(config *BylogFilterConfig) {
+		config.PrometheusAddr = addr
+	}
+	f := newTestFilter(t, setup)
+	f.doMetric(dimKey([]string{"b1", "user_login"}), 0, 0, "", MTypeOK)
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `bpid="b1"`) {
+		t.Errorf("got metrics %q", body)
+	}
+
+	fr := &fakeFilterRunner{in: make(chan *pipeline.PipelinePack)}
+	close(fr.in)
+	if err = f.Run(fr, &fakePluginHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	// a restarted plugin serves the same address again
+	g := newTestFilter(t, setup)
+	g.prom.Close()
+}
+
+func TestStateSkipsUnchangedSaves(t *testing.T) {
+	state_file := filepath.Join(t.TempDir(), "bylog.state")
+	f := newTestFilter(t, func(config *BylogFilterConfig) {
+		config.StateFile = state_file
+	})
+	dims := dimKey([]string{"b1", "user_login"})
+	f.doMetric(dims, 0, 0, "", MTypeOK)
+	f.saveState()
+	if err := os.Remove(state_file); err != nil {
+		t.Fatal(err)
+	}
+
+	f.saveState()
+	if _, err := os.Stat(state_file); !os.IsNotExist(err) {
+		t.Errorf("saved unchanged counters: %v", err)
+	}
+	f.doMetric(dims, 0, 0, "", MTypeOK)
+	f.saveState()
+	if _, err := os.Stat(state_file); err != nil {
+		t.Errorf("changed counters not saved: %v", err)
+	}
+}
+
+// fakeFilterRunner feeds Run from in and records the payloads it injects.
+// Methods Run does not use panic through the nil embedded interface.
+type fakeFilterRunner struct {
+	pipeline.FilterRunner
+	in chan *pipeline.PipelinePack
+
+	sync.Mutex
+	payloads []string
+	errors   []error
+}
+
+func (fr *fakeFilterRunner) InChan() chan *pipeline.PipelinePack { return fr.in }
+func (fr *fakeFilterRunner) Name() string                        { return "BylogFilter" }
+
+func (fr *fakeFilterRunner) Inject(pack *pipeline.PipelinePack) bool {
+	fr.Lock()
+	fr.payloads = append(fr.payloads, pack.Message.GetPayload())
+	fr.Unlock()
+	return true
+}
+
+func (fr *fakeFilterRunner) LogError(err error) {
+	fr.Lock()
+	fr.errors = append(fr.errors, err)
+	fr.Unlock()
+}
+
+func (fr *fakeFilterRunner) LogMessage(msg string) {}
+
+type fakePluginHelper struct {
+	pipeline.PluginHelper
+}
+
+func (h *fakePluginHelper) PipelinePack(msgLoopCount uint) *pipeline.PipelinePack {
+	return pipeline.NewPipelinePack(nil)
+}
+
+func newTestPack(recycle chan *pipeline.PipelinePack, bpid, api string, metric_type MetricType) *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(recycle)
+	for _, kv := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"Bpid", bpid},
+		{"ApiName", api},
+		{"Error", int64(metric_type)},
+		{"LogAt", time.Now().Unix()},
+		{"JsonString", `{"uid":"u1"}`},
+	} {
+		f, err := message.NewField(kv.name, kv.value, "")
+		if err != nil {
+			panic(err)
+		}
+		pack.Message.AddField(f)
+	}
+	return pack
+}
+
+// TestRunDeliversCountsOnce sends from several goroutines while the timer
+// flushes every second, then checks that the csv rows add up to exactly
+// what was sent. Run it with -race.
+func TestRunDeliversCountsOnce(t *testing.T) {
+	f := newTestFilter(t, func(config *BylogFilterConfig) {
+		config.MetricInterval = 1
+	})
+	fr := &fakeFilterRunner{in: make(chan *pipeline.PipelinePack, 16)}
+
+	const senders, per_sender = 4, 300
+	recycle := make(chan *pipeline.PipelinePack, senders*per_sender)
+	done := make(chan error)
+	go func() {
+		done <- f.Run(fr, &fakePluginHelper{})
+	}()
+
+	var wg sync.WaitGroup
+	sent := make(map[string]int)
+	for i := 0; i < senders; i++ {
+		bpid := fmt.Sprintf("b%d", i)
+		sent[bpid+",user_login,"+metricTypeNames[MTypeOK]] = per_sender - per_sender/10
+		sent[bpid+",user_login,"+metricTypeNames[MTypeDropJsonError]] = per_sender / 10
+		wg.Add(1)
+		go func(bpid string) {
+			defer wg.Done()
+			for n := 0; n < per_sender; n++ {
+				metric_type := MTypeOK
+				if n%10 == 0 {
+					metric_type = MTypeDropJsonError
+				}
+				fr.in <- newTestPack(recycle, bpid, "user_login", metric_type)
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(bpid)
+	}
+	wg.Wait()
+	close(fr.in)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recycle) != senders*per_sender {
+		t.Errorf("recycled %d packs, want %d", len(recycle), senders*per_sender)
+	}
+	if len(fr.errors) > 0 {
+		t.Errorf("got errors: %v", fr.errors)
+	}
+
+	got := make(map[string]int)
+	rows := 0
+	for _, payload := range fr.payloads {
+		for _, row := range strings.Split(strings.TrimSpace(payload), "\n") {
+			fields := strings.Split(row, ",")
+			if len(fields) < 4+int(MTypeMaxNum) {
+				t.Fatalf("short row: %q", row)
+			}
+			rows++
+			for i := 0; i < int(MTypeMaxNum); i++ {
+				count, err := strconv.Atoi(fields[4+i])
+				if err != nil {
+					t.Fatalf("row %q: %v", row, err)
+				}
+				if count > 0 {
+					got[fields[1]+","+fields[2]+","+metricTypeNames[i]] += count
+				}
+			}
+		}
+	}
+	if rows <= senders {
+		t.Errorf("got %d rows, want flushes from the timer as well as on shutdown", rows)
+	}
+	for key, count := range sent {
+		if got[key] != count {
+			t.Errorf("%s: delivered %d, sent %d", key, got[key], count)
+		}
+	}
+	for key, count := range got {
+		if _, ok := sent[key]; !ok {
+			t.Errorf("%s: delivered %d, sent none", key, count)
+		}
+	}
+}
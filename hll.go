@@ -0,0 +1,118 @@
+package csv
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the number of distinct strings added to it with
+// 2^precision one byte registers and a standard error of about
+// 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	p         uint8
+	registers []uint8
+}
+
+func NewHyperLogLog(precision int) (*HyperLogLog, error) {
+	if precision < 4 || precision > 18 {
+		return nil, fmt.Errorf("hyperloglog precision must be between 4 and 18")
+	}
+	return &HyperLogLog{p: uint8(precision), registers: make([]uint8, 1<<uint(precision))}, nil
+}
+
+func (h *HyperLogLog) Add(s string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(s))
+	x := mix64(hash.Sum64())
+
+	idx := x >> (64 - h.p)
+	rank := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// mix64 spreads the fnv hash over all bits, the register index uses the
+// top ones.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// Merge adds the registers of other, which must have the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.p != other.p {
+		return fmt.Errorf("hyperloglog precision mismatch: %d and %d", h.p, other.p)
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// String returns the sketch as base64 of the precision byte followed by the
+// registers, which ParseHyperLogLog reads back.
+func (h *HyperLogLog) String() string {
+	b := make([]byte, 0, len(h.registers)+1)
+	b = append(b, h.p)
+	b = append(b, h.registers...)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func ParseHyperLogLog(s string) (*HyperLogLog, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty hyperloglog sketch")
+	}
+	h, err := NewHyperLogLog(int(b[0]))
+	if err != nil {
+		return nil, err
+	}
+	if len(b)-1 != len(h.registers) {
+		return nil, fmt.Errorf("hyperloglog sketch has %d registers, want %d", len(b)-1, len(h.registers))
+	}
+	copy(h.registers, b[1:])
+	return h, nil
+}
@@ -0,0 +1,189 @@
+package csv
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IpLocationDB resolves IPs from a local range file. Each line is either
+// "cidr,country,province,city,country_code" or
+// "start_ip,end_ip,country,province,city,country_code".
+// Ranges must not overlap. With a positive interval a lookup checks the
+// file at most once per interval and reloads it when its modification time
+// changed, so no goroutine outlives the encoder.
+type IpLocationDB struct {
+	sync.RWMutex
+	file      string
+	interval  time.Duration
+	mtime     time.Time
+	checked   time.Time
+	ranges    []ipRange
+	reloading int32
+}
+
+type ipRange struct {
+	start, end                            net.IP
+	country, province, city, country_code string
+}
+
+func NewIpLocationDB(file string, interval time.Duration) (*IpLocationDB, error) {
+	db := &IpLocationDB{file: file, interval: interval}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	db.checked = time.Now()
+	return db, nil
+}
+
+func (db *IpLocationDB) Lookup(ip string) (map[string]interface{}, error) {
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ip: %s", ip)
+	}
+	addr = addr.To16()
+	if db.interval > 0 {
+		db.checkReload()
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].end, addr) >= 0
+	})
+	if i == len(db.ranges) || bytes.Compare(db.ranges[i].start, addr) > 0 {
+		return nil, fmt.Errorf("ip not found: %s", ip)
+	}
+	r := db.ranges[i]
+	return map[string]interface{}{
+		"country":      r.country,
+		"province":     r.province,
+		"city":         r.city,
+		"country_code": r.country_code,
+	}, nil
+}
+
+// checkReload reloads the file when interval passed since the last check.
+// Only one lookup reloads, the others go on with the old ranges.
+func (db *IpLocationDB) checkReload() {
+	db.RLock()
+	due := time.Since(db.checked) >= db.interval
+	db.RUnlock()
+	if !due || !atomic.CompareAndSwapInt32(&db.reloading, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&db.reloading, 0)
+
+	db.Lock()
+	db.checked = time.Now()
+	db.Unlock()
+	if err := db.reload(); err != nil {
+		LogError.Printf("reload %s fail: %v\n", db.file, err)
+	}
+}
+
+func (db *IpLocationDB) reload() error {
+	fi, err := os.Stat(db.file)
+	if err != nil {
+		return err
+	}
+	db.RLock()
+	unchanged := fi.ModTime().Equal(db.mtime)
+	db.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	ranges, err := loadIpRanges(db.file)
+	if err != nil {
+		return err
+	}
+
+	db.Lock()
+	db.ranges = ranges
+	db.mtime = fi.ModTime()
+	db.Unlock()
+	LogInfo.Printf("Load %d ip ranges from %s\n", len(ranges), db.file)
+	return nil
+}
+
+func loadIpRanges(file string) ([]ipRange, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	var ranges []ipRange
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var r ipRange
+		var info []string
+		switch len(record) {
+		case 5:
+			_, ipnet, e := net.ParseCIDR(strings.TrimSpace(record[0]))
+			if e != nil {
+				return nil, fmt.Errorf("%s: %d: %v", file, line, e)
+			}
+			r.start = ipnet.IP.To16()
+			r.end = make(net.IP, len(r.start))
+			mask := ipnet.Mask
+			if len(mask) == net.IPv4len {
+				mask = append(net.CIDRMask(96, 128)[:12], mask...)
+			}
+			for i := range r.start {
+				r.end[i] = r.start[i] | ^mask[i]
+			}
+			info = record[1:]
+		case 6:
+			r.start = net.ParseIP(strings.TrimSpace(record[0])).To16()
+			r.end = net.ParseIP(strings.TrimSpace(record[1])).To16()
+			if r.start == nil || r.end == nil || bytes.Compare(r.start, r.end) > 0 {
+				return nil, fmt.Errorf("%s: %d: invalid ip range", file, line)
+			}
+			info = record[2:]
+		default:
+			return nil, fmt.Errorf("%s: %d: invalid field num: %d", file, line, len(record))
+		}
+		r.country = info[0]
+		r.province = info[1]
+		r.city = info[2]
+		r.country_code = info[3]
+		ranges = append(ranges, r)
+	}
+
+	sort.Sort(byIpStart(ranges))
+	for i := 1; i < len(ranges); i++ {
+		if bytes.Compare(ranges[i].start, ranges[i-1].end) <= 0 {
+			return nil, fmt.Errorf("%s: overlapping ip ranges: %s-%s and %s-%s", file,
+				ranges[i-1].start, ranges[i-1].end, ranges[i].start, ranges[i].end)
+		}
+	}
+	return ranges, nil
+}
+
+type byIpStart []ipRange
+
+func (s byIpStart) Len() int           { return len(s) }
+func (s byIpStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byIpStart) Less(i, j int) bool { return bytes.Compare(s[i].start, s[j].start) < 0 }
@@ -0,0 +1,111 @@
+package csv
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const testIpRanges = `# cidr or start,end
+10.0.0.0/8,China,Beijing,Beijing,CN
+192.168.1.0,192.168.1.255,China,Shanghai,Shanghai,CN
+2001:db8::/32,Korea,Seoul,Seoul,KR
+`
+
+func writeIpRanges(t *testing.T, name, content string, mtime time.Time) {
+	writeTestFile(t, name, content)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIpLocationLookup(t *testing.T) {
+	pipeline.LogInfo = log.New(ioutil.Discard, "", 0)
+	file := filepath.Join(t.TempDir(), "ip.csv")
+	writeTestFile(t, file, testIpRanges)
+	db, err := NewIpLocationDB(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		city string
+	}{
+		{"10.0.0.0", "Beijing"},
+		{"10.255.255.255", "Beijing"},
+		{" 10.1.2.3 ", "Beijing"},
+		{"192.168.1.0", "Shanghai"},
+		{"192.168.1.255", "Shanghai"},
+		{"2001:db8:ffff::1", "Seoul"},
+		{"9.255.255.255", ""},
+		{"11.0.0.0", ""},
+		{"192.168.2.0", ""},
+		{"2001:db9::1", ""},
+		{"not an ip", ""},
+	}
+	for _, test := range tests {
+		info, err := db.Lookup(test.ip)
+		if len(test.city) == 0 {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.ip, info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.ip, err)
+		} else if info["city"] != test.city {
+			t.Errorf("%s: got city %v, want %s", test.ip, info["city"], test.city)
+		}
+	}
+}
+
+func TestLoadIpRangesErrors(t *testing.T) {
+	for _, content := range []string{
+		"10.0.0.0/8,China,Beijing,Beijing,CN\n10.1.0.0/16,China,Tianjin,Tianjin,CN\n",
+		"10.0.0.0,10.0.0.255,a,b,c,d\n10.0.0.255,10.0.1.255,a,b,c,d\n",
+		"10.0.0.0/33,China,Beijing,Beijing,CN\n",
+		"10.0.0.9,10.0.0.1,a,b,c,d\n",
+		"10.0.0.0,a,b,c,d,e\n",
+		"10.0.0.0/8,China,Beijing\n",
+	} {
+		file := filepath.Join(t.TempDir(), "ip.csv")
+		writeTestFile(t, file, content)
+		if _, err := loadIpRanges(file); err == nil {
+			t.Errorf("%q: got no error", content)
+		}
+	}
+}
+
+func TestIpLocationReload(t *testing.T) {
+	pipeline.LogInfo = log.New(ioutil.Discard, "", 0)
+	pipeline.LogError = log.New(ioutil.Discard, "", 0)
+	file := filepath.Join(t.TempDir(), "ip.csv")
+	mtime := time.Now().Add(-time.Hour)
+	writeIpRanges(t, file, testIpRanges, mtime)
+	db, err := NewIpLocationDB(file, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid file keeps the loaded ranges
+	writeIpRanges(t, file, "10.0.0.0/8,a,b,c,d\n10.0.0.0/16,a,b,c,d\n", mtime.Add(time.Minute))
+	time.Sleep(20 * time.Millisecond)
+	if info, err := db.Lookup("10.1.2.3"); err != nil || info["city"] != "Beijing" {
+		t.Errorf("after an invalid file: got %v, %v", info, err)
+	}
+
+	writeIpRanges(t, file, "10.0.0.0/8,China,Tianjin,Tianjin,CN\n", mtime.Add(2*time.Minute))
+	time.Sleep(20 * time.Millisecond)
+	if info, err := db.Lookup("10.1.2.3"); err != nil || info["city"] != "Tianjin" {
+		t.Errorf("after a change: got %v, %v", info, err)
+	}
+	if _, err := db.Lookup("192.168.1.1"); err == nil {
+		t.Error("range of the old file still found")
+	}
+}
@@ -0,0 +1,293 @@
+package csv
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+var defaultLocationFields = map[string]string{
+	"country":      "country",
+	"province":     "province",
+	"city":         "city",
+	"country_code": "country_code",
+}
+
+// IpLocationEnricher looks up the first input key holding a string.
+type IpLocationEnricher struct {
+	en     *CsvEncoder
+	keys   []string
+	prefix string
+	fields map[string]string
+}
+
+func (e *IpLocationEnricher) Init(en *CsvEncoder, conf *EnricherConfig) error {
+	if len(conf.Input) == 0 {
+		return fmt.Errorf("input not set")
+	}
+	e.en = en
+	e.keys = conf.Input
+	e.prefix, e.fields = locationOutput(conf)
+	return nil
+}
+
+func (e *IpLocationEnricher) Enrich(jmap map[string]interface{}) error {
+	if len(e.en.config.LocationSvrAddr) == 0 && e.en.ip_location_db == nil {
+		return nil
+	}
+
+	for _, key := range e.keys {
+		ip, ok := jmap[key].(string)
+		if !ok {
+			continue
+		}
+		ipinfo, err := e.en.queryIpLocation(ip)
+		if err != nil {
+			return fmt.Errorf("queryLocationInfo fail: %v", err)
+		}
+		setLocationInfo(jmap, e.prefix, e.fields, ipinfo)
+		return nil
+	}
+	return nil
+}
+
+// PhoneLocationEnricher tries its rules in order and looks up the
+// transform key of the first rule whose condition matches the record.
+type PhoneLocationEnricher struct {
+	en    *CsvEncoder
+	rules []*phoneRule
+}
+
+type phoneRule struct {
+	cond      *Condition
+	transform string
+	prefix    string
+	fields    map[string]string
+}
+
+func (e *PhoneLocationEnricher) Init(en *CsvEncoder, conf *EnricherConfig) error {
+	e.en = en
+
+	var entries []phoneLocationMapEntry
+	if rules, ok := conf.Args["rules"]; ok {
+		if err := decodeJson(rules, &entries); err != nil {
+			return fmt.Errorf("rules: %v", err)
+		}
+	} else {
+		entry := phoneLocationMapEntry{}
+		if err := decodeJson(conf.Args, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("rules not set")
+	}
+
+	for i, entry := range entries {
+		rule := &phoneRule{transform: entry.Transform}
+		if len(rule.transform) == 0 && len(conf.Input) > 0 {
+			rule.transform = conf.Input[0]
+		}
+		if len(rule.transform) == 0 {
+			return fmt.Errorf("rule %d: transform not set", i)
+		}
+
+		switch {
+		case entry.When != nil:
+			rule.cond = entry.When
+		case len(entry.Where) > 0:
+			rule.cond = &Condition{Key: entry.Where, Value: entry.EqualTo}
+		default:
+			return fmt.Errorf("rule %d: condition not set", i)
+		}
+		if err := rule.cond.Compile(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+
+		rule.prefix, rule.fields = locationOutput(conf)
+		if len(entry.Prefix) > 0 {
+			rule.prefix = entry.Prefix
+		}
+		if len(entry.Fields) > 0 {
+			rule.fields = entry.Fields
+		}
+		e.rules = append(e.rules, rule)
+	}
+	return nil
+}
+
+func (e *PhoneLocationEnricher) Enrich(jmap map[string]interface{}) error {
+	if len(e.en.config.LocationSvrAddr) == 0 {
+		return nil
+	}
+
+	for _, rule := range e.rules {
+		if !rule.cond.Match(jmap) {
+			continue
+		}
+		phone, ok := jmap[rule.transform].(string)
+		if !ok {
+			return nil
+		}
+		phone_info, err := queryLocationInfo(e.en.config.LocationSvrAddr, "phone", phone)
+		if err != nil {
+			return fmt.Errorf("queryLocationInfo fail: %v", err)
+		}
+		setLocationInfo(jmap, rule.prefix, rule.fields, phone_info)
+		return nil
+	}
+	return nil
+}
+
+func locationOutput(conf *EnricherConfig) (prefix string, fields map[string]string) {
+	prefix = conf.Prefix
+	if len(prefix) == 0 {
+		prefix = "x_"
+	}
+	fields = conf.Fields
+	if len(fields) == 0 {
+		fields = defaultLocationFields
+	}
+	return
+}
+
+// setLocationInfo copies the selected keys of a location result, skipping
+// any the result does not have.
+func setLocationInfo(jmap map[string]interface{}, prefix string, fields map[string]string, info map[string]interface{}) {
+	for key, name := range fields {
+		switch value := info[key].(type) {
+		case nil:
+		case string:
+			jmap[prefix+name] = value
+		default:
+			jmap[prefix+name] = fmt.Sprintf("%v", value)
+		}
+	}
+}
+
+// An api_ip_location_map entry is either the ip key, an object like
+//
+//	{"ip": "server_ip", "prefix": "x_server_", "fields": {"country": "country"}}
+//
+// or a list of such objects to enrich several ip keys of one record.
+type ipLocationMapEntry struct {
+	Ip     string            `json:"ip"`
+	Prefix string            `json:"prefix"`
+	Fields map[string]string `json:"fields"`
+}
+
+func ipLocationConfigs(v interface{}) (map[string][]EnricherConfig, error) {
+	apis, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+
+	confs := make(map[string][]EnricherConfig)
+	for api, value := range apis {
+		var entries []ipLocationMapEntry
+		switch value := value.(type) {
+		case string:
+			entries = append(entries, ipLocationMapEntry{Ip: value})
+		case map[string]interface{}:
+			entry := ipLocationMapEntry{}
+			if err := decodeJson(value, &entry); err != nil {
+				return nil, fmt.Errorf("%s: %v", api, err)
+			}
+			entries = append(entries, entry)
+		case []interface{}:
+			if err := decodeJson(value, &entries); err != nil {
+				return nil, fmt.Errorf("%s: %v", api, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: invalid entry", api)
+		}
+
+		for _, entry := range entries {
+			if len(entry.Ip) == 0 {
+				return nil, fmt.Errorf("%s: ip not set", api)
+			}
+			confs[api] = append(confs[api], EnricherConfig{
+				Type:   "ip_location",
+				Input:  []string{entry.Ip},
+				Prefix: entry.Prefix,
+				Fields: entry.Fields,
+			})
+		}
+	}
+	return confs, nil
+}
+
+// An api_phone_location_map entry is either one rule or a list of rules.
+// A rule has a condition, either "where"/"equal_to" or a Condition in
+// "when", and the "transform" key holding the phone to look up. Rules
+// lacking any of them are skipped, as the map always did.
+type phoneLocationMapEntry struct {
+	Where     string            `json:"where"`
+	EqualTo   string            `json:"equal_to"`
+	When      *Condition        `json:"when"`
+	Transform string            `json:"transform"`
+	Prefix    string            `json:"prefix"`
+	Fields    map[string]string `json:"fields"`
+}
+
+func phoneLocationConfigs(v interface{}) (map[string][]EnricherConfig, error) {
+	apis, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+
+	confs := make(map[string][]EnricherConfig)
+	for api, value := range apis {
+		var entries []interface{}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			entries = append(entries, value)
+		case []interface{}:
+			entries = value
+		default:
+			return nil, fmt.Errorf("%s: invalid entry", api)
+		}
+
+		var rules []interface{}
+		for i, rule := range entries {
+			if !phoneRuleComplete(rule) {
+				pipeline.LogError.Printf("api_phone_location_map: %s: skip incomplete rule %d\n", api, i)
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		confs[api] = append(confs[api], EnricherConfig{
+			Type: "phone_location",
+			Args: map[string]interface{}{"rules": rules},
+		})
+	}
+	return confs, nil
+}
+
+func phoneRuleComplete(rule interface{}) bool {
+	m, ok := rule.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if transform, _ := m["transform"].(string); len(transform) == 0 {
+		return false
+	}
+	if _, ok := m["when"]; ok {
+		return true
+	}
+	where, _ := m["where"].(string)
+	_, has_equal_to := m["equal_to"].(string)
+	return len(where) > 0 && has_equal_to
+}
+
+func init() {
+	RegisterEnricher("ip_location", func() Enricher {
+		return new(IpLocationEnricher)
+	})
+	RegisterEnricher("phone_location", func() Enricher {
+		return new(PhoneLocationEnricher)
+	})
+}
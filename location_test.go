@@ -0,0 +1,106 @@
+package csv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// newTestPhoneEncoder serves phone lookups answering with the looked up
+// number as the country, and loads the enrichers of api_maps.
+func newTestPhoneEncoder(t *testing.T, api_maps string) *CsvEncoder {
+	pipeline.LogError = log.New(ioutil.Discard, "", 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		phone := strings.TrimPrefix(r.URL.Path, "/location/phone=")
+		fmt.Fprintf(w, `{"code": 0, "country": %q}`, phone)
+	}))
+	t.Cleanup(server.Close)
+
+	en := &CsvEncoder{config: &CsvEncoderConfig{LocationSvrAddr: server.Listener.Addr().String()}}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(api_maps), &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := en.loadEnrichers(m); err != nil {
+		t.Fatal(err)
+	}
+	return en
+}
+
+func TestPhoneLocationMapShapes(t *testing.T) {
+	en := newTestPhoneEncoder(t, `{"api_phone_location_map": {
+		"user_signup": {"where": "type", "equal_to": "phone", "transform": "account"},
+		"user_login": [
+			{"where": "type", "equal_to": "phone", "transform": "account"},
+			{"when": {"key": "mobile", "op": "prefix", "value": "1"}, "transform": "mobile", "prefix": "m_"}
+		],
+		"user_bind": {"where": "type", "transform": "account"},
+		"user_pay": [
+			{"where": "type", "equal_to": "phone"},
+			{"when": {"key": "type", "op": "in", "value": ["phone", "mobile"]}, "transform": "account"}
+		]
+	}}`)
+
+	tests := []struct {
+		api    string
+		record string
+		key    string
+		want   string
+	}{
+		{"user_signup", `{"type": "phone", "account": "138"}`, "x_country", "138"},
+		{"user_signup", `{"type": "mail", "account": "a@b"}`, "x_country", ""},
+		// first matching rule wins
+		{"user_login", `{"type": "phone", "account": "138", "mobile": "139"}`, "x_country", "138"},
+		{"user_login", `{"type": "phone", "account": "138", "mobile": "139"}`, "m_country", ""},
+		{"user_login", `{"type": "mail", "account": "a@b", "mobile": "139"}`, "m_country", "139"},
+		// a legacy rule without equal_to is skipped
+		{"user_bind", `{"type": "", "account": "138"}`, "x_country", ""},
+		// a legacy rule without transform is skipped, the next one applies
+		{"user_pay", `{"type": "mobile", "account": "138"}`, "x_country", "138"},
+	}
+	for _, test := range tests {
+		record := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(test.record), &record); err != nil {
+			t.Fatal(err)
+		}
+		en.enrich(record, test.api)
+		got, _ := record[test.key].(string)
+		if got != test.want {
+			t.Errorf("%s %s: got %s %q, want %q", test.api, test.record, test.key, got, test.want)
+		}
+	}
+	if _, ok := en.api_enrichers["user_bind"]; ok {
+		t.Error("loaded an enricher without complete rules")
+	}
+}
+
+func TestPhoneLocationConfigsErrors(t *testing.T) {
+	for _, v := range []string{
+		`[]`,
+		`{"user_login": "account"}`,
+	} {
+		var m interface{}
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := phoneLocationConfigs(m); err == nil {
+			t.Errorf("%s: got no error", v)
+		}
+	}
+
+	// rules of the newer shape are still checked
+	m := make(map[string]interface{})
+	json.Unmarshal([]byte(`{"api_phone_location_map": {"user_login": {"when": {"key": "type", "op": "like", "value": "a"}, "transform": "account"}}}`), &m)
+	en := &CsvEncoder{config: &CsvEncoderConfig{}}
+	if err := en.loadEnrichers(m); err == nil {
+		t.Error("got no error for an invalid when condition")
+	}
+}
@@ -0,0 +1,87 @@
+package csv
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// metricPath joins the parts into a graphite/statsd path, replacing any
+// character but letters, digits, '_' and '-' in each part.
+func metricPath(parts ...string) string {
+	var clean []string
+	for _, p := range parts {
+		if len(p) == 0 {
+			p = "none"
+		}
+		clean = append(clean, metricNameInvalid.ReplaceAllString(p, "_"))
+	}
+	return strings.Join(clean, ".")
+}
+
+// maxDatagram keeps a udp payload within a common path MTU.
+const maxDatagram = 1400
+
+// MetricSender writes payloads to a "udp://host:port" or "tcp://host:port"
+// address, reconnecting a broken tcp connection on the next send.
+type MetricSender struct {
+	sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+func NewMetricSender(addr string) (*MetricSender, error) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") {
+		return nil, fmt.Errorf("invalid metric address: %s", addr)
+	}
+	return &MetricSender{network: parts[0], addr: parts[1]}, nil
+}
+
+func (s *MetricSender) Send(payload string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		if s.conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second); err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err = s.conn.Write([]byte(payload)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// SendLines writes lines ending in "\n" with a single write over tcp, or
+// packed into datagrams of up to maxDatagram bytes over udp. It stops at
+// the first error, so an unreachable address costs one dial per call
+// rather than one per line.
+func (s *MetricSender) SendLines(lines []string) error {
+	if s.network == "tcp" {
+		return s.Send(strings.Join(lines, ""))
+	}
+	var buf []byte
+	for _, line := range lines {
+		if len(buf) > 0 && len(buf)+len(line) > maxDatagram {
+			if err := s.Send(string(buf)); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		buf = append(buf, line...)
+	}
+	if len(buf) > 0 {
+		return s.Send(string(buf))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package csv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLines(n int) []string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("bylog.b%d.user_login.in:%d|c\n", i, i))
+	}
+	return lines
+}
+
+func TestSendLinesTcpOneConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string)
+	go func() {
+		var got []string
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			got = append(got, string(b))
+		}
+		received <- strings.Join(got, "|conn|")
+	}()
+
+	s, err := NewMetricSender("tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := testLines(500)
+	if err = s.SendLines(lines); err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	l.Close()
+
+	if got := <-received; got != strings.Join(lines, "") {
+		t.Errorf("got %d bytes over %d connections, want %d bytes over one",
+			len(got), strings.Count(got, "|conn|")+1, len(strings.Join(lines, "")))
+	}
+}
+
+func TestSendLinesUdpDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewMetricSender("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := testLines(200)
+	if err = s.SendLines(lines); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	buf := make([]byte, 65536)
+	for len(strings.Join(got, "")) < len(strings.Join(lines, "")) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > maxDatagram {
+			t.Errorf("got a datagram of %d bytes", n)
+		}
+		if !strings.HasSuffix(string(buf[:n]), "\n") {
+			t.Errorf("datagram splits a line: %q", buf[:n])
+		}
+		got = append(got, string(buf[:n]))
+	}
+	if len(got) < 2 || strings.Join(got, "") != strings.Join(lines, "") {
+		t.Errorf("got %d datagrams not adding up to the lines", len(got))
+	}
+}
+
+func TestSendLinesStopsAtDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := NewMetricSender("tcp://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SendLines(testLines(10)); err == nil {
+		t.Error("got no error from a closed port")
+	}
+}
@@ -5,14 +5,50 @@ import (
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"hash/fnv"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type PgOutput struct {
-	config  *PgOutputConfig
-	db_conn *sql.DB
+	config      *PgOutputConfig
+	db_conn     *sql.DB
+	spool       *Spool
+	csv_encoder *CsvEncoder
+	delimiter   string
+	tables      map[string]bool
+	partitions  map[string]bool
+	healthy     bool
+	ddl_lock    sync.Mutex
+	replaying   int32
+	queues      []chan *pgJob
+	queues_lock sync.RWMutex
+	wal         *Wal
+	wal_pending []string
+}
+
+// pgMetricColumns match the csv rows of BylogFilter with the default
+// dimensions, set pg_columns for others.
+var pgMetricColumns = []string{
+	"ftime", "fbpid", "fapi", "fhost",
+	"fcount_in",
+	"fcount_delay",
+	"fcount_timeerr",
+	"fcount_jsonerr",
+	"fcount_othererr",
+}
+
+// pgMetricStatColumns follow pgMetricColumns with pg_metric_stats.
+var pgMetricStatColumns = []string{
+	"fbytes",
+	"flag_min", "flag_avg", "flag_max",
+	"flag_p50", "flag_p95", "flag_p99",
 }
 
 type PgOutputConfig struct {
@@ -20,11 +56,102 @@ type PgOutputConfig struct {
 	PgTable   string `toml:"pg_table"`
 	PgSchema  string `toml:"pg_schema"`
 	BatchSize int    `toml:"batch_size"`
+	// A batch is also sent every flush_interval seconds and before it
+	// grows over batch_max_bytes.
+	FlushInterval int `toml:"flush_interval"`
+	BatchMaxBytes int `toml:"batch_max_bytes"`
+	// ApiName to table, others go to pg_table.
+	PgTables map[string]string `toml:"pg_tables"`
+	// Columns of every encoded row. When not set rows of a CsvEncoder go
+	// to log_date, api_name (if prefixed) and the fd-*.xml fields of their
+	// api, anything else to the BylogFilter metric columns.
+	PgColumns []string `toml:"pg_columns"`
+	// Row delimiter when the encoder is not a CsvEncoder.
+	Delimiter string `toml:"delimiter"`
+	// Also store the BylogFilter byte and lag statistics in the metric
+	// columns.
+	PgMetricStats bool `toml:"pg_metric_stats"`
+	// Also store the BylogFilter distinct uid estimate, and with
+	// pg_metric_uid_sketch the sketch. Both imply pg_metric_stats. When
+	// rows of one key are merged by the add upsert, fuids is only a lower
+	// bound; for exact counts append the rows and merge their sketches
+	// downstream with ParseHyperLogLog and Merge.
+	PgMetricUids      bool `toml:"pg_metric_uids"`
+	PgMetricUidSketch bool `toml:"pg_metric_uid_sketch"`
+	// Retries of a failed batch, waiting retry_interval ms doubled after
+	// each attempt up to retry_max_interval ms.
+	RetryTimes       int `toml:"retry_times"`
+	RetryInterval    int `toml:"retry_interval"`
+	RetryMaxInterval int `toml:"retry_max_interval"`
+	// Batches still failing are kept in spool_dir and replayed once a send
+	// succeeds again.
+	SpoolDir     string `toml:"spool_dir"`
+	SpoolMaxSize int64  `toml:"spool_max_size"`
+	// Merge rows on pg_conflict_columns instead of appending them. The
+	// other columns are replaced by the new row, or added to the old row
+	// with pg_upsert_mode "add".
+	PgUpsert          bool     `toml:"pg_upsert"`
+	PgUpsertMode      string   `toml:"pg_upsert_mode"`
+	PgConflictColumns []string `toml:"pg_conflict_columns"`
+	// Create the schema and tables when missing, with the types of
+	// pg_column_types or else of the CsvEncoder schema. pg_partition
+	// "daily" or "monthly" range partitions them on pg_partition_column,
+	// pg_partition_ahead partitions ahead, dropping those older than
+	// pg_retention_days.
+	PgCreateTable     bool              `toml:"pg_create_table"`
+	PgColumnTypes     map[string]string `toml:"pg_column_types"`
+	PgPartition       string            `toml:"pg_partition"`
+	PgPartitionColumn string            `toml:"pg_partition_column"`
+	PgPartitionAhead  int               `toml:"pg_partition_ahead"`
+	PgRetentionDays   int               `toml:"pg_retention_days"`
+	// Connection pool. pg_connect_policy "fail_fast" fails Init when the
+	// database can not be reached, "retry" pings pg_connect_retries times
+	// and then starts anyway, spooling until the database is back.
+	PgConnectPolicy  string `toml:"pg_connect_policy"`
+	PgConnectRetries int    `toml:"pg_connect_retries"`
+	MaxOpenConns     int    `toml:"max_open_conns"`
+	MaxIdleConns     int    `toml:"max_idle_conns"`
+	ConnMaxLifetime  int    `toml:"conn_max_lifetime"`
+	StatementTimeout int    `toml:"statement_timeout"`
+	SslMode          string `toml:"sslmode"`
+	SslCert          string `toml:"sslcert"`
+	SslKey           string `toml:"sslkey"`
+	SslRootCert      string `toml:"sslrootcert"`
+	// Batches are sent by writers goroutines through a queue of
+	// queue_size batches. With ordered set the batches of one api always
+	// go to the same writer and are written in order.
+	Writers   int  `toml:"writers"`
+	QueueSize int  `toml:"queue_size"`
+	Ordered   bool `toml:"ordered"`
+	// Rows are appended to a segment in wal_dir before the message is
+	// acknowledged, and segments of batches not stored are replayed on
+	// startup, skipping lines that do not decode; such a segment is then
+	// kept as "<name>.bad". wal_sync fsyncs every row.
+	WalDir  string `toml:"wal_dir"`
+	WalSync bool   `toml:"wal_sync"`
 }
 
 func (po *PgOutput) ConfigStruct() interface{} {
 	return &PgOutputConfig{
-		BatchSize: 1000,
+		BatchSize:         1000,
+		FlushInterval:     60,
+		BatchMaxBytes:     16 << 20,
+		Delimiter:         ",",
+		RetryTimes:        3,
+		RetryInterval:     1000,
+		RetryMaxInterval:  30000,
+		SpoolMaxSize:      1 << 30,
+		PgUpsertMode:      "replace",
+		PgConflictColumns: []string{"ftime", "fbpid", "fapi", "fhost"},
+		PgPartitionColumn: "ftime",
+		PgPartitionAhead:  3,
+		PgConnectPolicy:   "retry",
+		PgConnectRetries:  3,
+		MaxOpenConns:      4,
+		MaxIdleConns:      2,
+		ConnMaxLifetime:   3600,
+		Writers:           1,
+		QueueSize:         4,
 	}
 }
 
@@ -40,106 +167,579 @@ func (po *PgOutput) Init(config interface{}) (err error) {
 	if len(po.config.PgSchema) == 0 {
 		return fmt.Errorf("pg_schema not set")
 	}
-	po.db_conn, err = sql.Open("postgres", po.config.PgURL)
+	if po.config.BatchSize <= 0 {
+		return fmt.Errorf("batch_size must be positive")
+	}
+	if po.config.FlushInterval <= 0 {
+		return fmt.Errorf("flush_interval must be positive")
+	}
+	if po.config.Writers <= 0 {
+		return fmt.Errorf("writers must be positive")
+	}
+	if po.config.PgUpsert {
+		switch po.config.PgUpsertMode {
+		case "add", "replace":
+		default:
+			return fmt.Errorf("pg_upsert_mode must be add or replace")
+		}
+		if len(po.config.PgConflictColumns) == 0 {
+			return fmt.Errorf("pg_conflict_columns not set")
+		}
+	}
+	switch po.config.PgPartition {
+	case "", "daily", "monthly":
+	default:
+		return fmt.Errorf("pg_partition must be daily or monthly")
+	}
+	if len(po.config.PgPartition) > 0 && !po.config.PgCreateTable {
+		return fmt.Errorf("pg_partition needs pg_create_table")
+	}
+	po.tables = make(map[string]bool)
+	po.partitions = make(map[string]bool)
+	switch po.config.PgConnectPolicy {
+	case "fail_fast", "retry":
+	default:
+		return fmt.Errorf("pg_connect_policy must be fail_fast or retry")
+	}
+
+	dsn, err := pgDSN(po.config)
+	if err != nil {
+		return
+	}
+	po.db_conn, err = sql.Open("postgres", dsn)
 	if err != nil {
 		return
 	}
+	po.db_conn.SetMaxOpenConns(po.config.MaxOpenConns)
+	po.db_conn.SetMaxIdleConns(po.config.MaxIdleConns)
+	po.db_conn.SetConnMaxLifetime(time.Duration(po.config.ConnMaxLifetime) * time.Second)
+
+	if len(po.config.SpoolDir) > 0 {
+		if po.spool, err = NewSpool(po.config.SpoolDir, po.config.SpoolMaxSize); err != nil {
+			return
+		}
+	}
+	if len(po.config.WalDir) > 0 {
+		if po.wal, po.wal_pending, err = OpenWal(po.config.WalDir, po.config.WalSync); err != nil {
+			return
+		}
+	}
 
+	if err = po.connect(); err != nil {
+		if po.config.PgConnectPolicy == "fail_fast" {
+			return fmt.Errorf("connect to db fail: %v", err)
+		}
+		LogError.Printf("Connect to db fail, continue: %v\n", err)
+		return nil
+	}
+	po.healthy = true
 	LogInfo.Println("Connect to db success.")
 	return
 }
 
+// pgDSN adds the pool and tls settings to pg_url, which is either a
+// postgres:// url or a "key=value" connection string.
+func pgDSN(config *PgOutputConfig) (string, error) {
+	params := make(map[string]string)
+	if config.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.Itoa(config.StatementTimeout)
+	}
+	if len(config.SslMode) > 0 {
+		params["sslmode"] = config.SslMode
+	}
+	if len(config.SslCert) > 0 {
+		params["sslcert"] = config.SslCert
+	}
+	if len(config.SslKey) > 0 {
+		params["sslkey"] = config.SslKey
+	}
+	if len(config.SslRootCert) > 0 {
+		params["sslrootcert"] = config.SslRootCert
+	}
+	if len(params) == 0 {
+		return config.PgURL, nil
+	}
+
+	if strings.HasPrefix(config.PgURL, "postgres://") || strings.HasPrefix(config.PgURL, "postgresql://") {
+		u, err := url.Parse(config.PgURL)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	dsn := config.PgURL
+	for k, v := range params {
+		v = strings.Replace(v, `\`, `\\`, -1)
+		v = strings.Replace(v, `'`, `\'`, -1)
+		dsn += fmt.Sprintf(" %s='%s'", k, v)
+	}
+	return dsn, nil
+}
+
+// connect pings the database, retrying with backoff under the "retry"
+// policy.
+func (po *PgOutput) connect() (err error) {
+	interval := time.Duration(po.config.RetryInterval) * time.Millisecond
+	for n := 0; ; n++ {
+		if err = po.db_conn.Ping(); err == nil {
+			return
+		}
+		if po.config.PgConnectPolicy == "fail_fast" || n >= po.config.PgConnectRetries {
+			return
+		}
+		LogError.Printf("Ping db fail, retry %d in %s: %v\n", n+1, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// apiBatch holds encoded rows with the ApiName of their message.
+type apiBatch struct {
+	apis   []string
+	points []string
+	bytes  int
+}
+
+func newApiBatch(size int) *apiBatch {
+	return &apiBatch{
+		apis:   make([]string, 0, size),
+		points: make([]string, 0, size),
+	}
+}
+
+func (b *apiBatch) add(api string, point string) {
+	b.apis = append(b.apis, api)
+	b.points = append(b.points, point)
+	b.bytes += len(point)
+}
+
+// groups splits the rows by api, apis in order of first appearance.
+func (b *apiBatch) groups() (order []string, groups map[string][]string) {
+	groups = make(map[string][]string)
+	for i, api := range b.apis {
+		if _, ok := groups[api]; !ok {
+			order = append(order, api)
+		}
+		groups[api] = append(groups[api], b.points[i])
+	}
+	return
+}
+
+func (b *apiBatch) reset() {
+	b.apis = b.apis[:0]
+	b.points = b.points[:0]
+	b.bytes = 0
+}
+
+type pgJob struct {
+	api    string
+	points []string
+	by     string
+	seg    *walSegment
+}
+
 func (po *PgOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	if or.Encoder() == nil {
 		return errors.New("Encoder required")
 	}
+	po.delimiter = po.config.Delimiter
+	if en, ok := or.Encoder().(*CsvEncoder); ok {
+		po.csv_encoder = en
+		po.delimiter = en.config.Delimiter
+	}
 
 	var outBytes []byte
 	var e error
-	var i int = 0
-	var timer *time.Ticker
 
-	timer = time.NewTicker(time.Duration(60) * time.Second)
-	points := make([]string, po.config.BatchSize)
+	timer := time.NewTicker(time.Duration(po.config.FlushInterval) * time.Second)
+	defer timer.Stop()
+	var maintainC <-chan time.Time
+	if len(po.config.PgPartition) > 0 {
+		maintain := time.NewTicker(time.Hour)
+		defer maintain.Stop()
+		maintainC = maintain.C
+		po.maintainTables(or)
+	}
+	po.replaySpool(or, 0)
+	po.replayWal(or)
+
+	var wg sync.WaitGroup
+	po.startWriters(or, &wg)
+	defer func() {
+		for _, queue := range po.queues {
+			close(queue)
+		}
+		wg.Wait()
+		if po.wal != nil {
+			po.wal.Close()
+		}
+	}()
+
+	batch := newApiBatch(po.config.BatchSize)
 	for {
 		select {
 		case pack, ok := <-or.InChan():
 			if !ok {
-				if i > 0 && i <= 1000 {
-					e = po.sendPoints(points[:i])
-					if e != nil {
-						or.LogError(fmt.Errorf("fail send points: %d, %v", i, e))
-					} else {
-						or.LogMessage(fmt.Sprintf("send metrics to pg success(by shutdown): i = %d", i))
-					}
-				}
+				po.flush(or, batch, "shutdown")
 				return
 			}
 			if outBytes, e = or.Encode(pack); e != nil {
 				or.LogError(fmt.Errorf("Error encoding message: %s", e.Error()))
 			} else if outBytes != nil {
-				points[i] = string(outBytes)
-				i++
-				if i >= po.config.BatchSize {
-					e = po.sendPoints(points[:i])
-					if e != nil {
-						or.LogError(fmt.Errorf("fail send points: %d, %v", i, e))
-					} else {
-						or.LogMessage(fmt.Sprintf("send metrics to pg success: i = %d", i))
+				if po.config.BatchMaxBytes > 0 && batch.bytes+len(outBytes) > po.config.BatchMaxBytes {
+					po.flush(or, batch, "bytes")
+				}
+				api := packApiName(pack)
+				if po.wal != nil {
+					if e = po.appendWal(api, string(outBytes)); e != nil {
+						// Stop without recycling the pack, it is not
+						// acknowledged. Rows already in the wal are sent
+						// or replayed on the next start.
+						po.flush(or, batch, "shutdown")
+						return fmt.Errorf("wal append: %v", e)
 					}
-					i = 0
-					timer = time.NewTicker(time.Duration(30) * time.Second)
+				}
+				batch.add(api, string(outBytes))
+				if len(batch.points) >= po.config.BatchSize {
+					po.flush(or, batch, "size")
 				}
 			}
 			pack.Recycle()
 		case <-timer.C:
-			if i > 0 && i <= 1000 {
-				e = po.sendPoints(points[:i])
-				if e != nil {
-					or.LogError(fmt.Errorf("fail send points: %d, %v", i, e))
-				} else {
-					or.LogMessage(fmt.Sprintf("send metrics to pg success(by timer): i = %d", i))
-				}
-				i = 0
+			po.checkHealth(or)
+			// The writers replay the rest after a successful send.
+			if po.healthy {
+				po.replaySpool(or, 1)
 			}
+			po.flush(or, batch, "timer")
+		case <-maintainC:
+			po.maintainTables(or)
 		}
 	}
 	return
 }
 
-func (po *PgOutput) sendPoints(points []string) error {
+// appendWal retries a failed append retry_times times, waiting as
+// sendPointsRetry does.
+func (po *PgOutput) appendWal(api string, point string) (err error) {
+	interval := time.Duration(po.config.RetryInterval) * time.Millisecond
+	max_interval := time.Duration(po.config.RetryMaxInterval) * time.Millisecond
+	for n := 0; ; n++ {
+		if err = po.wal.Append(api, point); err == nil || n >= po.config.RetryTimes {
+			return
+		}
+		LogError.Printf("wal append fail, retry %d in %s: %v\n", n+1, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > max_interval {
+			interval = max_interval
+		}
+	}
+}
+
+// checkHealth pings the database and logs when it goes down or comes back.
+// database/sql replaces broken connections by itself.
+func (po *PgOutput) checkHealth(or OutputRunner) {
+	err := po.db_conn.Ping()
+	if err != nil && po.healthy {
+		or.LogError(fmt.Errorf("db unreachable: %v", err))
+	} else if err == nil && !po.healthy {
+		or.LogMessage("db reachable again")
+	}
+	po.healthy = err == nil
+}
+
+func (po *PgOutput) maintainTables(or OutputRunner) {
+	for _, table := range po.configTables() {
+		if err := po.maintainPartitions(table); err != nil {
+			or.LogError(fmt.Errorf("maintain partitions of %s: %v", table, err))
+		}
+	}
+}
+
+// startWriters starts one queue per writer when ordered, else one queue
+// shared by all writers.
+func (po *PgOutput) startWriters(or OutputRunner, wg *sync.WaitGroup) {
+	n := 1
+	if po.config.Ordered {
+		n = po.config.Writers
+	}
+	queues := make([]chan *pgJob, n)
+	for i := range queues {
+		queues[i] = make(chan *pgJob, po.config.QueueSize)
+	}
+	// ReportMsg reads the queues from the report goroutine.
+	po.queues_lock.Lock()
+	po.queues = queues
+	po.queues_lock.Unlock()
+	for i := 0; i < po.config.Writers; i++ {
+		wg.Add(1)
+		go func(queue chan *pgJob) {
+			defer wg.Done()
+			po.writer(or, queue)
+		}(po.queues[i%n])
+	}
+}
+
+func (po *PgOutput) writer(or OutputRunner, queue chan *pgJob) {
+	for job := range queue {
+		n := len(job.points)
+		saved, e := po.sendGroup(job.api, job.points)
+		if e != nil {
+			or.LogError(fmt.Errorf("fail send points: %s, %d, %v", job.api, n, e))
+		} else {
+			or.LogMessage(fmt.Sprintf("send metrics to pg success(by %s): %s i = %d", job.by, job.api, n))
+			po.replaySpool(or, 0)
+		}
+		job.seg.done(saved)
+	}
+}
+
+// flush queues the batch grouped by api and empties it. It blocks while
+// the queue is full.
+func (po *PgOutput) flush(or OutputRunner, batch *apiBatch, by string) {
+	if len(batch.points) == 0 {
+		return
+	}
+
+	order, groups := batch.groups()
+	var seg *walSegment
+	if po.wal != nil {
+		name, err := po.wal.Seal()
+		if err != nil {
+			or.LogError(fmt.Errorf("wal seal: %v", err))
+		}
+		seg = &walSegment{name: name, pending: int32(len(order))}
+	}
+	for _, api := range order {
+		queue := po.queues[0]
+		if len(po.queues) > 1 {
+			h := fnv.New32a()
+			h.Write([]byte(api))
+			queue = po.queues[h.Sum32()%uint32(len(po.queues))]
+		}
+		queue <- &pgJob{api: api, points: groups[api], by: by, seg: seg}
+	}
+	batch.reset()
+}
+
+// sendGroup sends points of one api with retries and spools them when
+// every attempt fails. A spooled group is still reported as an error;
+// saved tells whether the points were either sent or spooled.
+func (po *PgOutput) sendGroup(api string, points []string) (saved bool, err error) {
+	err = po.sendPointsRetry(api, points)
+	if err == nil {
+		return true, nil
+	}
+	if po.spool == nil {
+		return false, err
+	}
+	if e := po.spool.Put(api, points); e != nil {
+		return false, fmt.Errorf("%v, spool fail: %v", err, e)
+	}
+	return true, fmt.Errorf("%v, spooled", err)
+}
+
+// replayWal stores the rows of segments left by the last run.
+func (po *PgOutput) replayWal(or OutputRunner) {
+	for _, name := range po.wal_pending {
+		apis, points, bad, err := ReadWalSegment(name)
+		if err != nil {
+			or.LogError(fmt.Errorf("read wal segment: %v", err))
+			continue
+		}
+		if bad > 0 {
+			or.LogError(fmt.Errorf("wal segment %s: skip %d bad lines, keep it as %s.bad", name, bad, name))
+		}
+		batch := &apiBatch{apis: apis, points: points}
+		order, groups := batch.groups()
+		seg := &walSegment{name: name, pending: int32(len(order) + 1), bad: bad > 0}
+		for _, api := range order {
+			saved, e := po.sendGroup(api, groups[api])
+			if e != nil {
+				or.LogError(fmt.Errorf("fail replay wal: %s, %d, %v", api, len(groups[api]), e))
+			}
+			seg.done(saved)
+		}
+		seg.done(true)
+		or.LogMessage(fmt.Sprintf("replay wal segment %s: %d points", name, len(points)))
+	}
+	po.wal_pending = nil
+}
+
+func (po *PgOutput) sendPointsRetry(api string, points []string) (err error) {
+	interval := time.Duration(po.config.RetryInterval) * time.Millisecond
+	max_interval := time.Duration(po.config.RetryMaxInterval) * time.Millisecond
+	for n := 0; ; n++ {
+		if err = po.sendPoints(api, points); err == nil || n >= po.config.RetryTimes {
+			return
+		}
+		LogError.Printf("send points fail, retry %d in %s: %v\n", n+1, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > max_interval {
+			interval = max_interval
+		}
+	}
+}
+
+// replaySpool sends spooled batches oldest first until one fails, or
+// until max batches were sent when max > 0. Only one goroutine replays at a
+// time. Files that can not be read are left for the next replay.
+func (po *PgOutput) replaySpool(or OutputRunner, max int) {
+	if po.spool == nil || !atomic.CompareAndSwapInt32(&po.replaying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&po.replaying, 0)
+	for n := 0; max <= 0 || n < max; n++ {
+		file, api, points, err := po.spool.Oldest()
+		if len(file) == 0 {
+			return
+		}
+		if _, bad := err.(*BadSpoolError); bad {
+			or.LogError(fmt.Errorf("drop %v", err))
+			po.spool.Remove(file)
+			continue
+		}
+		if err != nil {
+			or.LogError(fmt.Errorf("read spool file %s: %v", file, err))
+			return
+		}
+		if err = po.sendPoints(api, points); err != nil {
+			return
+		}
+		if err = po.spool.Remove(file); err != nil {
+			or.LogError(fmt.Errorf("remove spool file %s: %v", file, err))
+			return
+		}
+		files, _ := po.spool.Stats()
+		or.LogMessage(fmt.Sprintf("replay spool success: %d points, %d files left", len(points), files))
+	}
+}
+
+func (po *PgOutput) tableFor(api string) string {
+	if table, ok := po.config.PgTables[api]; ok {
+		return table
+	}
+	return po.config.PgTable
+}
+
+func (po *PgOutput) columnsFor(api string) []string {
+	if len(po.config.PgColumns) > 0 {
+		return po.config.PgColumns
+	}
+	if po.csv_encoder == nil {
+		return po.metricColumns()
+	}
+	apiconfig, ok := po.csv_encoder.apiconfigs[api]
+	if !ok {
+		return po.metricColumns()
+	}
+
+	var columns []string
+	if po.csv_encoder.config.PrefixWithDate {
+		columns = append(columns, "log_date")
+	}
+	if po.csv_encoder.config.PrefixWithApi {
+		columns = append(columns, "api_name")
+	}
+	for _, arg := range apiconfig.args {
+		columns = append(columns, arg.aName)
+	}
+	return columns
+}
+
+// metricColumns follows the csv rows of BylogFilter, where the uid
+// columns come after the statistics.
+func (po *PgOutput) metricColumns() []string {
+	uids := po.config.PgMetricUids || po.config.PgMetricUidSketch
+	if !po.config.PgMetricStats && !uids {
+		return pgMetricColumns
+	}
+	columns := append([]string{}, pgMetricColumns...)
+	columns = append(columns, pgMetricStatColumns...)
+	if uids {
+		columns = append(columns, "fuids")
+	}
+	if po.config.PgMetricUidSketch {
+		columns = append(columns, "fuid_sketch")
+	}
+	return columns
+}
+
+func packApiName(pack *PipelinePack) string {
+	if f := pack.Message.FindFirstField("ApiName"); f != nil {
+		if api, ok := f.GetValue().(string); ok {
+			return api
+		}
+	}
+	return ""
+}
+
+func (po *PgOutput) ReportMsg(msg *message.Message) error {
+	queued := 0
+	po.queues_lock.RLock()
+	for _, queue := range po.queues {
+		queued += len(queue)
+	}
+	po.queues_lock.RUnlock()
+	message.NewInt64Field(msg, "QueuedBatches", int64(queued), "count")
+	if po.spool == nil {
+		return nil
+	}
+	files, size := po.spool.Stats()
+	message.NewInt64Field(msg, "SpoolFiles", int64(files), "count")
+	message.NewInt64Field(msg, "SpoolBytes", size, "B")
+	return nil
+}
+
+func (po *PgOutput) sendPoints(api string, points []string) (err error) {
+	columns := po.columnsFor(api)
+	if po.config.PgCreateTable {
+		if err = po.ensureTable(api, columns, points); err != nil {
+			return err
+		}
+	}
+
 	txn, err := po.db_conn.Begin()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+		}
+	}()
 
-	stmt, err := txn.Prepare(pq.CopyInSchema(po.config.PgSchema, po.config.PgTable,
-		"ftime", "fbpid", "fapi", "fhost",
-		"fcount_in",
-		"fcount_delay",
-		"fcount_timeerr",
-		"fcount_jsonerr",
-		"fcount_othererr"))
+	var stmt *sql.Stmt
+	if po.config.PgUpsert {
+		if _, err = txn.Exec(pgStagingSQL(po.config.PgSchema, po.tableFor(api))); err != nil {
+			return err
+		}
+		stmt, err = txn.Prepare(pq.CopyIn(pgStagingTable, columns...))
+	} else {
+		stmt, err = txn.Prepare(pq.CopyInSchema(po.config.PgSchema, po.tableFor(api), columns...))
+	}
 	if err != nil {
 		return err
 	}
 
+	values := make([]interface{}, len(columns))
 	for _, p := range points {
-		fields := strings.Split(p, ",")
-		if len(fields) < 4+int(MTypeMaxNum) {
+		fields := strings.Split(strings.TrimRight(p, "\r\n"), po.delimiter)
+		if len(fields) < len(columns) {
 			return fmt.Errorf("fields num not fit for pg: %s", p)
 		}
-		_, err = stmt.Exec(
-			fields[0],
-			fields[1],
-			fields[2],
-			fields[3],
-			fields[4],
-			fields[5],
-			fields[6],
-			fields[7],
-			fields[8],
-		)
+		for i := range columns {
+			values[i] = fields[i]
+		}
+		_, err = stmt.Exec(values...)
 		if err != nil {
 			return err
 		}
@@ -152,6 +752,13 @@ func (po *PgOutput) sendPoints(points []string) error {
 	if err != nil {
 		return err
 	}
+	if po.config.PgUpsert {
+		merge := pgMergeSQL(po.config.PgSchema, po.tableFor(api), columns,
+			po.config.PgConflictColumns, po.config.PgUpsertMode == "add")
+		if _, err = txn.Exec(merge); err != nil {
+			return err
+		}
+	}
 	err = txn.Commit()
 	if err != nil {
 		return err
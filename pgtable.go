@@ -0,0 +1,375 @@
+package csv
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	. "github.com/mozilla-services/heka/pipeline"
+	"strings"
+	"time"
+)
+
+const pgStagingTable = "pg_output_staging"
+
+func pgTableName(schema, table string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+}
+
+func pgQuoteColumns(columns []string) []string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = pq.QuoteIdentifier(c)
+	}
+	return quoted
+}
+
+// pgStagingSQL creates the per-transaction table upsert rows are copied to.
+func pgStagingSQL(schema, table string) string {
+	return fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+		pq.QuoteIdentifier(pgStagingTable), pgTableName(schema, table))
+}
+
+// pgAddMerge lists the columns that are not summed with add. "min" and
+// "max" keep the lowest or highest value, "last" the newest one, "avg" the
+// mean weighted by pgAvgWeight. Quantiles can not be merged from rows, so
+// flag_p* of a key written more than once are only approximate.
+var pgAddMerge = map[string]string{
+	"flag_min": "min",
+	"flag_max": "max",
+	"flag_avg": "avg",
+	"flag_p50": "last",
+	"flag_p95": "last",
+	"flag_p99": "last",
+	// Distinct counts do not add up, the larger estimate is a lower bound
+	// for a key written more than once. fuid_sketch keeps the newest
+	// partial sketch, see PgMetricUidSketch.
+	"fuids":       "max",
+	"fuid_sketch": "last",
+}
+
+// pgAvgWeight are the counts of the messages an "avg" column is the mean
+// of. Without them in the columns the newest value is kept.
+var pgAvgWeight = []string{"fcount_in", "fcount_delay"}
+
+// pgWeightedAvg returns the "avg" select and update of column q, or false
+// when the weight columns are missing.
+func pgWeightedAvg(q string, columns []string) (string, string, bool) {
+	has := make(map[string]bool)
+	for _, c := range columns {
+		has[c] = true
+	}
+	var w, tw, ew []string
+	for _, c := range pgAvgWeight {
+		if !has[c] {
+			return "", "", false
+		}
+		w = append(w, pq.QuoteIdentifier(c))
+		tw = append(tw, "t."+pq.QuoteIdentifier(c))
+		ew = append(ew, "EXCLUDED."+pq.QuoteIdentifier(c))
+	}
+	weight := strings.Join(w, " + ")
+	sel := fmt.Sprintf("COALESCE(sum(%s * (%s)) / NULLIF(sum(%s), 0), 0)", q, weight, weight)
+	update := fmt.Sprintf("%s = COALESCE((t.%s * (%s) + EXCLUDED.%s * (%s)) / NULLIF(%s + %s, 0), 0)",
+		q, q, strings.Join(tw, " + "), q, strings.Join(ew, " + "), strings.Join(tw, " + "), strings.Join(ew, " + "))
+	return sel, update, true
+}
+
+// pgMergeSQL moves the staging rows into the table. Rows of one batch with
+// the same conflict key are summed when add is set, or merged as
+// pgAddMerge says, otherwise the last one is kept, since ON CONFLICT can
+// not touch a row twice.
+func pgMergeSQL(schema, table string, columns, conflict []string, add bool) string {
+	is_key := make(map[string]bool)
+	for _, c := range conflict {
+		is_key[c] = true
+	}
+
+	keys := pgQuoteColumns(conflict)
+	var selects, updates []string
+	for _, c := range columns {
+		q := pq.QuoteIdentifier(c)
+		merge := pgAddMerge[c]
+		if add && merge == "avg" {
+			if sel, update, ok := pgWeightedAvg(q, columns); ok {
+				selects = append(selects, sel)
+				updates = append(updates, update)
+				continue
+			}
+			merge = "last"
+		}
+		switch {
+		case is_key[c]:
+			selects = append(selects, q)
+		case add && merge == "min":
+			selects = append(selects, fmt.Sprintf("min(%s)", q))
+			updates = append(updates, fmt.Sprintf("%s = LEAST(t.%s, EXCLUDED.%s)", q, q, q))
+		case add && merge == "max":
+			selects = append(selects, fmt.Sprintf("max(%s)", q))
+			updates = append(updates, fmt.Sprintf("%s = GREATEST(t.%s, EXCLUDED.%s)", q, q, q))
+		case add && merge == "last":
+			selects = append(selects, fmt.Sprintf("(array_agg(%s ORDER BY ctid DESC))[1]", q))
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", q, q))
+		case add:
+			selects = append(selects, fmt.Sprintf("sum(%s)", q))
+			updates = append(updates, fmt.Sprintf("%s = t.%s + EXCLUDED.%s", q, q, q))
+		default:
+			selects = append(selects, q)
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", q, q))
+		}
+	}
+
+	var query string
+	if add {
+		query = fmt.Sprintf("SELECT %s FROM %s GROUP BY %s",
+			strings.Join(selects, ", "), pq.QuoteIdentifier(pgStagingTable), strings.Join(keys, ", "))
+	} else {
+		query = fmt.Sprintf("SELECT DISTINCT ON (%s) %s FROM %s ORDER BY %s, ctid DESC",
+			strings.Join(keys, ", "), strings.Join(selects, ", "), pq.QuoteIdentifier(pgStagingTable),
+			strings.Join(keys, ", "))
+	}
+
+	action := "DO NOTHING"
+	if len(updates) > 0 {
+		action = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+	return fmt.Sprintf("INSERT INTO %s AS t (%s) %s ON CONFLICT (%s) %s",
+		pgTableName(schema, table), strings.Join(pgQuoteColumns(columns), ", "), query,
+		strings.Join(keys, ", "), action)
+}
+
+// pgColumnTypes are used for columns created by pg_create_table when
+// neither pg_column_types nor the CsvEncoder schema give a type.
+var pgColumnTypes = map[string]string{
+	"ftime":           "timestamp",
+	"fbpid":           "text",
+	"fapi":            "text",
+	"fhost":           "text",
+	"fcount_in":       "bigint",
+	"fcount_delay":    "bigint",
+	"fcount_timeerr":  "bigint",
+	"fcount_jsonerr":  "bigint",
+	"fcount_othererr": "bigint",
+	"fbytes":          "bigint",
+	"flag_min":        "bigint",
+	"flag_avg":        "double precision",
+	"flag_max":        "bigint",
+	"flag_p50":        "bigint",
+	"flag_p95":        "bigint",
+	"flag_p99":        "bigint",
+	"fuids":           "bigint",
+	"fuid_sketch":     "text",
+	"log_date":        "date",
+	"api_name":        "text",
+}
+
+func pgArgType(t string) string {
+	switch t {
+	case "int":
+		return "bigint"
+	case "float":
+		return "double precision"
+	case "datetime":
+		return "timestamp"
+	case "datetime_float":
+		return "timestamp(3)"
+	default:
+		return "text"
+	}
+}
+
+func (po *PgOutput) columnType(api string, column string) string {
+	if t, ok := po.config.PgColumnTypes[column]; ok {
+		return t
+	}
+	if po.csv_encoder != nil {
+		if apiconfig, ok := po.csv_encoder.apiconfigs[api]; ok {
+			for _, arg := range apiconfig.args {
+				if arg.aName == column {
+					return pgArgType(arg.aType)
+				}
+			}
+		}
+	}
+	if t, ok := pgColumnTypes[column]; ok {
+		return t
+	}
+	return "text"
+}
+
+// ensureTable creates the table of api and the partitions the points
+// fall in, once per table and partition.
+func (po *PgOutput) ensureTable(api string, columns []string, points []string) error {
+	po.ddl_lock.Lock()
+	defer po.ddl_lock.Unlock()
+
+	table := po.tableFor(api)
+	if !po.tables[table] {
+		var defs []string
+		for _, c := range columns {
+			defs = append(defs, pq.QuoteIdentifier(c)+" "+po.columnType(api, c))
+		}
+		if po.config.PgUpsert {
+			defs = append(defs, fmt.Sprintf("UNIQUE (%s)",
+				strings.Join(pgQuoteColumns(po.config.PgConflictColumns), ", ")))
+		}
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)",
+			pgTableName(po.config.PgSchema, table), strings.Join(defs, ", "))
+		if len(po.config.PgPartition) > 0 {
+			query += fmt.Sprintf(" PARTITION BY RANGE (%s)", pq.QuoteIdentifier(po.config.PgPartitionColumn))
+		}
+
+		if _, err := po.db_conn.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(po.config.PgSchema)); err != nil {
+			return err
+		}
+		if _, err := po.db_conn.Exec(query); err != nil {
+			return err
+		}
+		po.tables[table] = true
+		LogInfo.Printf("Table %s.%s ready\n", po.config.PgSchema, table)
+
+		if err := po.maintainTablePartitions(table); err != nil {
+			return err
+		}
+	}
+
+	if len(po.config.PgPartition) == 0 {
+		return nil
+	}
+	idx := -1
+	for i, c := range columns {
+		if c == po.config.PgPartitionColumn {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil
+	}
+	for _, p := range points {
+		fields := strings.Split(p, po.delimiter)
+		if idx >= len(fields) || len(fields[idx]) < 10 {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", fields[idx][:10], time.Local)
+		if err != nil {
+			continue
+		}
+		if err = po.ensurePartition(table, po.partitionStart(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (po *PgOutput) partitionStart(t time.Time) time.Time {
+	year, month, day := t.Date()
+	if po.config.PgPartition == "monthly" {
+		day = 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+func (po *PgOutput) partitionNext(start time.Time) time.Time {
+	if po.config.PgPartition == "monthly" {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func (po *PgOutput) partitionLayout() string {
+	if po.config.PgPartition == "monthly" {
+		return "200601"
+	}
+	return "20060102"
+}
+
+func (po *PgOutput) ensurePartition(table string, start time.Time) error {
+	name := table + "_p" + start.Format(po.partitionLayout())
+	if po.partitions[name] {
+		return nil
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+		pgTableName(po.config.PgSchema, name), pgTableName(po.config.PgSchema, table),
+		start.Format("2006-01-02"), po.partitionNext(start).Format("2006-01-02"))
+	if _, err := po.db_conn.Exec(query); err != nil {
+		return err
+	}
+	po.partitions[name] = true
+	return nil
+}
+
+// maintainPartitions creates the partitions of table from the current one
+// to pg_partition_ahead ahead and drops the ones older than
+// pg_retention_days. Tables not created yet are skipped.
+func (po *PgOutput) maintainPartitions(table string) error {
+	po.ddl_lock.Lock()
+	defer po.ddl_lock.Unlock()
+	return po.maintainTablePartitions(table)
+}
+
+func (po *PgOutput) maintainTablePartitions(table string) error {
+	if len(po.config.PgPartition) == 0 {
+		return nil
+	}
+
+	var exists bool
+	err := po.db_conn.QueryRow("SELECT to_regclass($1) IS NOT NULL",
+		pgTableName(po.config.PgSchema, table)).Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+
+	start := po.partitionStart(time.Now())
+	for i := 0; i <= po.config.PgPartitionAhead; i++ {
+		if err = po.ensurePartition(table, start); err != nil {
+			return err
+		}
+		start = po.partitionNext(start)
+	}
+
+	if po.config.PgRetentionDays <= 0 {
+		return nil
+	}
+	rows, err := po.db_conn.Query(`SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		JOIN pg_namespace n ON n.oid = p.relnamespace
+		WHERE n.nspname = $1 AND p.relname = $2`, po.config.PgSchema, table)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	expire := time.Now().AddDate(0, 0, -po.config.PgRetentionDays)
+	for _, name := range names {
+		if !strings.HasPrefix(name, table+"_p") {
+			continue
+		}
+		start, e := time.ParseInLocation(po.partitionLayout(), name[len(table)+2:], time.Local)
+		if e != nil || po.partitionNext(start).After(expire) {
+			continue
+		}
+		if _, err = po.db_conn.Exec("DROP TABLE IF EXISTS " + pgTableName(po.config.PgSchema, name)); err != nil {
+			return err
+		}
+		delete(po.partitions, name)
+		LogInfo.Printf("Drop partition %s.%s\n", po.config.PgSchema, name)
+	}
+	return nil
+}
+
+// configTables are the tables rows may be routed to.
+func (po *PgOutput) configTables() []string {
+	tables := []string{po.config.PgTable}
+	for _, table := range po.config.PgTables {
+		tables = append(tables, table)
+	}
+	return tables
+}
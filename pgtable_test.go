@@ -0,0 +1,44 @@
+package csv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPgMergeSQLAdd(t *testing.T) {
+	columns := append(append([]string{}, pgMetricColumns...), pgMetricStatColumns...)
+	columns = append(columns, "fuids", "fuid_sketch")
+	query := pgMergeSQL("public", "bylog", columns, []string{"ftime", "fbpid", "fapi", "fhost"}, true)
+
+	for _, want := range []string{
+		`sum("fcount_in")`,
+		`"fcount_in" = t."fcount_in" + EXCLUDED."fcount_in"`,
+		`min("flag_min")`,
+		`"flag_min" = LEAST(t."flag_min", EXCLUDED."flag_min")`,
+		`max("flag_max")`,
+		`"flag_max" = GREATEST(t."flag_max", EXCLUDED."flag_max")`,
+		`(array_agg("flag_p99" ORDER BY ctid DESC))[1]`,
+		`COALESCE(sum("flag_avg" * ("fcount_in" + "fcount_delay")) / NULLIF(sum("fcount_in" + "fcount_delay"), 0), 0)`,
+		`"flag_avg" = COALESCE((t."flag_avg" * (t."fcount_in" + t."fcount_delay") + EXCLUDED."flag_avg" * (EXCLUDED."fcount_in" + EXCLUDED."fcount_delay")) / NULLIF(t."fcount_in" + t."fcount_delay" + EXCLUDED."fcount_in" + EXCLUDED."fcount_delay", 0), 0)`,
+		`max("fuids")`,
+		`"fuids" = GREATEST(t."fuids", EXCLUDED."fuids")`,
+		`"fuid_sketch" = EXCLUDED."fuid_sketch"`,
+		`GROUP BY "ftime", "fbpid", "fapi", "fhost"`,
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("merge sql lacks %s: %s", want, query)
+		}
+	}
+	for _, c := range []string{"flag_min", "flag_max", "flag_avg", "flag_p50", "flag_p95", "flag_p99", "fuids", "fuid_sketch"} {
+		if strings.Contains(query, `sum("`+c+`")`) {
+			t.Errorf("merge sql sums %s: %s", c, query)
+		}
+	}
+}
+
+func TestPgMergeSQLAvgWithoutWeights(t *testing.T) {
+	query := pgMergeSQL("public", "bylog", []string{"ftime", "fbpid", "flag_avg"}, []string{"ftime", "fbpid"}, true)
+	if !strings.Contains(query, `"flag_avg" = EXCLUDED."flag_avg"`) {
+		t.Errorf("merge sql does not keep the newest flag_avg: %s", query)
+	}
+}
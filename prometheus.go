@@ -0,0 +1,118 @@
+package csv
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PromCounter keeps cumulative counts by dimensions and metric type for the
+// Prometheus text exposition format. Unlike Counter it is never reset, so
+// past max_keys distinct dimensions new ones are counted as "_other".
+type PromCounter struct {
+	sync.Mutex
+	labels   []string
+	max_keys int
+	dims     map[string]bool
+	m        map[promKey]int64
+	listener net.Listener
+}
+
+type promKey struct {
+	dims string
+	t    MetricType
+}
+
+func NewPromCounter(labels []string, max_keys int) *PromCounter {
+	return &PromCounter{
+		labels:   labels,
+		max_keys: max_keys,
+		dims:     make(map[string]bool),
+		m:        make(map[promKey]int64),
+	}
+}
+
+func (p *PromCounter) Inc(dims string, t MetricType) {
+	p.Lock()
+	if !p.dims[dims] {
+		if p.max_keys > 0 && len(p.dims) >= p.max_keys {
+			dims = otherDims(len(p.labels))
+		}
+		p.dims[dims] = true
+	}
+	p.m[promKey{dims, t}]++
+	p.Unlock()
+}
+
+// Serve listens on addr and serves the counters on /metrics.
+func (p *PromCounter) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	p.listener = listener
+	p.Unlock()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	go func() {
+		err := http.Serve(listener, mux)
+		p.Lock()
+		closed := p.listener != listener
+		p.Unlock()
+		if !closed {
+			LogError.Printf("prometheus endpoint %s stopped: %v\n", addr, err)
+		}
+	}()
+	return nil
+}
+
+// Close stops listening, so the address can be served again.
+func (p *PromCounter) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.listener == nil {
+		return nil
+	}
+	err := p.listener.Close()
+	p.listener = nil
+	return err
+}
+
+func (p *PromCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	keys := make([]promKey, 0, len(p.m))
+	counts := make(map[promKey]int64, len(p.m))
+	for k, v := range p.m {
+		keys = append(keys, k)
+		counts[k] = v
+	}
+	p.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].dims != keys[j].dims {
+			return keys[i].dims < keys[j].dims
+		}
+		return keys[i].t < keys[j].t
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("# HELP bylog_messages_total Messages counted by BylogFilter.\n")
+	buf.WriteString("# TYPE bylog_messages_total counter\n")
+	for _, k := range keys {
+		buf.WriteString("bylog_messages_total{")
+		for i, value := range splitDims(k.dims) {
+			fmt.Fprintf(&buf, "%s=\"%s\",", p.labels[i], promEscaper.Replace(value))
+		}
+		fmt.Fprintf(&buf, "type=\"%s\"} %d\n", metricTypeNames[k.t], counts[k])
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,128 @@
+package csv
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// LagStats summarizes ingestion lags in seconds: min, max, mean and
+// quantiles from a log-bucketed histogram with about 1% relative error.
+// Lags under one second share bucket 0.
+type LagStats struct {
+	n        int64
+	sum      int64
+	min, max int64
+	buckets  map[int]int64
+}
+
+const lagSketchGamma = 1.02
+
+func NewLagStats() *LagStats {
+	return &LagStats{buckets: make(map[int]int64)}
+}
+
+func (s *LagStats) Add(lag int64) {
+	if lag < 0 {
+		lag = 0
+	}
+	if s.n == 0 || lag < s.min {
+		s.min = lag
+	}
+	if s.n == 0 || lag > s.max {
+		s.max = lag
+	}
+	s.n++
+	s.sum += lag
+
+	idx := 0
+	if lag >= 1 {
+		idx = int(math.Ceil(math.Log(float64(lag))/math.Log(lagSketchGamma))) + 1
+	}
+	s.buckets[idx]++
+}
+
+func (s *LagStats) Avg() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return float64(s.sum) / float64(s.n)
+}
+
+// Quantile returns the q (0..1) quantile, clamped to [min, max].
+func (s *LagStats) Quantile(q float64) int64 {
+	if s.n == 0 {
+		return 0
+	}
+	idxs := make([]int, 0, len(s.buckets))
+	for idx := range s.buckets {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	rank := int64(math.Ceil(q * float64(s.n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	var v int64
+	for _, idx := range idxs {
+		seen += s.buckets[idx]
+		if seen >= rank {
+			if idx > 0 {
+				// the middle of (gamma^(idx-2), gamma^(idx-1)]
+				v = int64(math.Round(2 * math.Pow(lagSketchGamma, float64(idx-1)) / (1 + lagSketchGamma)))
+			}
+			break
+		}
+	}
+	if v < s.min {
+		v = s.min
+	}
+	if v > s.max {
+		v = s.max
+	}
+	return v
+}
+
+// Merge adds the lags of other.
+func (s *LagStats) Merge(other *LagStats) {
+	if other.n == 0 {
+		return
+	}
+	if s.n == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.n == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.n += other.n
+	s.sum += other.sum
+	for idx, count := range other.buckets {
+		s.buckets[idx] += count
+	}
+}
+
+type lagStatsJson struct {
+	N       int64         `json:"n"`
+	Sum     int64         `json:"sum"`
+	Min     int64         `json:"min"`
+	Max     int64         `json:"max"`
+	Buckets map[int]int64 `json:"buckets"`
+}
+
+func (s *LagStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(lagStatsJson{s.n, s.sum, s.min, s.max, s.buckets})
+}
+
+func (s *LagStats) UnmarshalJSON(b []byte) error {
+	var j lagStatsJson
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	s.n, s.sum, s.min, s.max, s.buckets = j.N, j.Sum, j.Min, j.Max, j.Buckets
+	if s.buckets == nil {
+		s.buckets = make(map[int]int64)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package csv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spool keeps batches that could not be delivered as one json file per
+// batch in dir, oldest first, up to max_size bytes in total. Each batch
+// carries a key telling the owner where it belongs.
+type Spool struct {
+	sync.Mutex
+	dir      string
+	max_size int64
+	size     int64
+	files    []string
+}
+
+func NewSpool(dir string, max_size int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	s := &Spool{dir: dir, max_size: max_size, files: files}
+	for _, file := range files {
+		if fi, e := os.Stat(file); e == nil {
+			s.size += fi.Size()
+		}
+	}
+	return s, nil
+}
+
+type spoolBatch struct {
+	Key    string   `json:"key"`
+	Points []string `json:"points"`
+}
+
+func (s *Spool) Put(key string, points []string) error {
+	b, err := json.Marshal(spoolBatch{Key: key, Points: points})
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.max_size > 0 && s.size+int64(len(b)) > s.max_size {
+		return fmt.Errorf("spool full: %d bytes in %s", s.size, s.dir)
+	}
+
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d.spool", time.Now().UnixNano()))
+	tmp := strings.TrimSuffix(name, ".spool") + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.files = append(s.files, name)
+	s.size += int64(len(b))
+	return nil
+}
+
+// BadSpoolError is returned by Oldest for a file that was read but can not
+// be decoded, so it will never be replayed.
+type BadSpoolError struct {
+	File string
+	Err  error
+}
+
+func (e *BadSpoolError) Error() string {
+	return fmt.Sprintf("bad spool file %s: %v", e.File, e.Err)
+}
+
+// Oldest returns the oldest spooled batch, or an empty file name when the
+// spool is empty.
+func (s *Spool) Oldest() (file string, key string, points []string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.files) == 0 {
+		return "", "", nil, nil
+	}
+	file = s.files[0]
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return file, "", nil, err
+	}
+	batch := spoolBatch{}
+	if err = json.Unmarshal(b, &batch); err != nil {
+		return file, "", nil, &BadSpoolError{file, err}
+	}
+	return file, batch.Key, batch.Points, nil
+}
+
+func (s *Spool) Remove(file string) error {
+	s.Lock()
+	defer s.Unlock()
+	fi, err := os.Stat(file)
+	if err == nil {
+		s.size -= fi.Size()
+		err = os.Remove(file)
+	}
+	for i, f := range s.files {
+		if f == file {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			break
+		}
+	}
+	return err
+}
+
+func (s *Spool) Stats() (files int, size int64) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.files), s.size
+}
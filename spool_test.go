@@ -0,0 +1,62 @@
+package csv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolOldest(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("user_login", []string{"a,b\n", "c,d\n"}); err != nil {
+		t.Fatal(err)
+	}
+	file, key, points, err := s.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "user_login" || len(points) != 2 || points[1] != "c,d\n" {
+		t.Errorf("got batch %q %q", key, points)
+	}
+	if err = s.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if files, size := s.Stats(); files != 0 || size != 0 {
+		t.Errorf("got %d files of %d bytes after remove", files, size)
+	}
+}
+
+func TestSpoolOldestErrors(t *testing.T) {
+	dir := t.TempDir()
+	// a file that can not be read, unlike one that does not decode, may
+	// read fine later
+	if err := os.Mkdir(filepath.Join(dir, "00000000000000000001.spool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000002.spool"), []byte(`{"key":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, _, _, err := s.Oldest()
+	if err == nil {
+		t.Fatal("got no error for an unreadable file")
+	}
+	if _, bad := err.(*BadSpoolError); bad {
+		t.Errorf("read error reported as a bad file: %v", err)
+	}
+	s.Remove(file)
+
+	_, _, _, err = s.Oldest()
+	if _, bad := err.(*BadSpoolError); !bad {
+		t.Errorf("got %v for a file that does not decode, want a BadSpoolError", err)
+	}
+}
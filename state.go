@@ -0,0 +1,138 @@
+package csv
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// counterState is the BylogFilter counter map saved in state_file. Counts
+// bucketed by receive time belong to the hour starting at Hour, which is
+// the hour of the last flush rather than of the save.
+type counterState struct {
+	Hour   int64          `json:"hour"`
+	Points []counterPoint `json:"points"`
+}
+
+type counterPoint struct {
+	Bucket int64     `json:"bucket"`
+	Dims   string    `json:"dims"`
+	Counts []int     `json:"counts"`
+	Bytes  int64     `json:"bytes"`
+	Lag    *LagStats `json:"lag"`
+	Uids   string    `json:"uids,omitempty"`
+}
+
+// saveState writes the counter map to state_file unless it is unchanged
+// since the last save. The map is encoded under the counter lock and
+// written after it.
+func (f *BylogFilter) saveState() {
+	if len(f.config.StateFile) == 0 {
+		return
+	}
+	f.counter.Lock()
+	version := f.counter.version
+	if version == f.saved_version {
+		f.counter.Unlock()
+		return
+	}
+	state := counterState{Hour: f.counter.hour}
+	for k, v := range f.counter.m {
+		p := counterPoint{Bucket: k.bucket, Dims: k.dims, Counts: v.counts, Bytes: v.bytes, Lag: v.lag}
+		if v.uids != nil {
+			p.Uids = v.uids.String()
+		}
+		state.Points = append(state.Points, p)
+	}
+	b, err := json.Marshal(state)
+	f.counter.Unlock()
+
+	if err == nil {
+		tmp := f.config.StateFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, f.config.StateFile)
+		}
+	}
+	if err != nil {
+		LogError.Printf("save counter state %s: %v\n", f.config.StateFile, err)
+		return
+	}
+	f.saved_version = version
+}
+
+// restoreState merges the counters saved in state_file. Receive time counts
+// of a past hour are delivered at once, labeled with that hour.
+func (f *BylogFilter) restoreState() error {
+	b, err := ioutil.ReadFile(f.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := counterState{}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("%s: %v", f.config.StateFile, err)
+	}
+
+	f.counter.RLock()
+	past := f.config.BucketBy != "log_at" && state.Hour < f.counter.hour
+	f.counter.RUnlock()
+	var points []string
+	for _, p := range state.Points {
+		if len(splitDims(p.Dims)) != len(f.dims) || len(p.Counts) != int(MTypeMaxNum) {
+			LogError.Printf("skip saved counter of other dimensions: %q\n", p.Dims)
+			continue
+		}
+		k := Key{p.Bucket, p.Dims}
+		v := f.newValue()
+		copy(v.counts, p.Counts)
+		v.bytes = p.Bytes
+		if p.Lag != nil {
+			v.lag = p.Lag
+		}
+		if v.uids != nil && len(p.Uids) > 0 {
+			if uids, e := ParseHyperLogLog(p.Uids); e == nil {
+				v.uids.Merge(uids)
+			}
+		}
+
+		if past {
+			t := time.Unix(state.Hour, 0)
+			point, e := f.formatPoint(k, v, t, t.Add(time.Hour))
+			if e != nil {
+				f.fr.LogError(e)
+				continue
+			}
+			points = append(points, point+"\n")
+			continue
+		}
+
+		f.counter.Lock()
+		if old, ok := f.counter.m[k]; ok {
+			for i := range v.counts {
+				v.counts[i] += old.counts[i]
+			}
+			v.bytes += old.bytes
+			v.lag.Merge(old.lag)
+			if v.uids != nil && old.uids != nil {
+				v.uids.Merge(old.uids)
+			}
+		}
+		f.counter.set(k, v)
+		f.counter.Unlock()
+	}
+	if past {
+		f.deliverMetrics(points)
+		LogInfo.Println("Saved hour: num of points delivered:", len(points))
+	} else if f.config.BucketBy == "log_at" {
+		f.alert_since = 0
+	} else {
+		f.alert_since = state.Hour
+	}
+	f.saveState()
+	return nil
+}
@@ -0,0 +1,82 @@
+package csv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Field transforms set by <Transform> in fd-*.xml. They run on the mapped
+// csv value, after enrichment, so lookups still see the raw value.
+//
+//	hash         hex HMAC-SHA256 keyed by hash_key_file
+//	ip_truncate  zero an ipv4 to /24, an ipv6 to /48
+//	mask         replace all but the last <Keep> characters with '*'
+//	drop         write the empty value of the field type
+func transformOK(t string) bool {
+	switch t {
+	case "", "hash", "ip_truncate", "mask", "drop":
+		return true
+	default:
+		return false
+	}
+}
+
+func (en *CsvEncoder) transformField(arg *ApiArg, v string) string {
+	if len(v) == 0 {
+		return v
+	}
+
+	switch arg.aTransform {
+	case "hash":
+		mac := hmac.New(sha256.New, en.hash_key)
+		mac.Write([]byte(v))
+		return hex.EncodeToString(mac.Sum(nil))
+	case "ip_truncate":
+		return truncateIp(v)
+	case "mask":
+		return maskKeepLast(v, arg.aKeep)
+	case "drop":
+		return typeEmptyValue(arg.aType)
+	default:
+		return v
+	}
+}
+
+func truncateIp(v string) string {
+	ip := net.ParseIP(strings.TrimSpace(v))
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func maskKeepLast(v string, keep int) string {
+	r := []rune(v)
+	for i := 0; i < len(r)-keep; i++ {
+		r[i] = '*'
+	}
+	return string(r)
+}
+
+func checkTransform(item *ApiFieldItem) error {
+	if !transformOK(item.Transform) {
+		return fmt.Errorf("invalid transform: %s", item.Transform)
+	}
+	switch item.Transform {
+	case "hash", "ip_truncate", "mask":
+		if item.Type != "str" {
+			return fmt.Errorf("transform %s needs type str", item.Transform)
+		}
+	}
+	if item.Keep < 0 {
+		return fmt.Errorf("invalid keep: %d", item.Keep)
+	}
+	return nil
+}
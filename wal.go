@@ -0,0 +1,155 @@
+package csv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Wal appends batched rows to a segment file in dir, one json record per
+// line. Seal starts a new segment for the next batch; a sealed segment is
+// removed once its batch is stored, and segments left by a crash are
+// replayed on startup.
+type Wal struct {
+	dir  string
+	sync bool
+	f    *os.File
+	name string
+	size int64
+}
+
+type walRecord struct {
+	Api   string `json:"a"`
+	Point string `json:"p"`
+}
+
+func OpenWal(dir string, sync bool) (w *Wal, pending []string, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if pending, err = filepath.Glob(filepath.Join(dir, "*.wal")); err != nil {
+		return
+	}
+	sort.Strings(pending)
+
+	w = &Wal{dir: dir, sync: sync}
+	if err = w.open(); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func (w *Wal) open() (err error) {
+	w.name = filepath.Join(w.dir, fmt.Sprintf("%020d.wal", time.Now().UnixNano()))
+	w.size = 0
+	w.f, err = os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0644)
+	return
+}
+
+// Append writes one record. On failure the segment is cut back to its
+// previous size, so the append can be retried.
+func (w *Wal) Append(api string, point string) error {
+	b, err := json.Marshal(walRecord{Api: api, Point: point})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err = w.f.Write(b); err == nil && w.sync {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.f.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(b))
+	return nil
+}
+
+// Seal closes the current segment and returns its name.
+func (w *Wal) Seal() (string, error) {
+	name := w.name
+	if err := w.f.Close(); err != nil {
+		return name, err
+	}
+	return name, w.open()
+}
+
+// Close closes and removes the current segment, which must be empty.
+func (w *Wal) Close() error {
+	w.f.Close()
+	return os.Remove(w.name)
+}
+
+// ReadWalSegment returns the records of a segment, ignoring a torn last
+// line. Other lines that do not decode are skipped and counted in bad.
+func ReadWalSegment(name string) (apis []string, points []string, bad int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, e := reader.ReadBytes('\n')
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, nil, 0, fmt.Errorf("%s: %v", name, e)
+		}
+		rec := walRecord{}
+		if e = json.Unmarshal(line, &rec); e != nil {
+			bad++
+			continue
+		}
+		apis = append(apis, rec.Api)
+		points = append(points, rec.Point)
+	}
+	return
+}
+
+// walSegment removes a sealed segment when all batches read from it are
+// done, unless one of them was lost. A segment with bad lines is renamed to
+// "<name>.bad" instead, so it is kept but not replayed again.
+type walSegment struct {
+	sync.Mutex
+	name    string
+	pending int32
+	lost    bool
+	bad     bool
+}
+
+func (s *walSegment) done(saved bool) {
+	if s == nil {
+		return
+	}
+	if !saved {
+		s.Lock()
+		s.lost = true
+		s.Unlock()
+	}
+	if atomic.AddInt32(&s.pending, -1) > 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.lost {
+		return
+	}
+	if s.bad {
+		if err := os.Rename(s.name, s.name+".bad"); err != nil {
+			LogError.Printf("move bad wal segment %s: %v\n", s.name, err)
+		}
+	} else if err := os.Remove(s.name); err != nil {
+		LogError.Printf("remove wal segment %s: %v\n", s.name, err)
+	}
+}
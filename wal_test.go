@@ -0,0 +1,58 @@
+package csv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWalSegmentBadLines(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "00000000000000000001.wal")
+	writeTestFile(t, name, `{"a":"user_login","p":"a,b\n"}
+{"a":"user_login","p":
+{"a":"user_pay","p":"c,d\n"}
+{"a":"user_pay","p":"e,`)
+
+	apis, points, bad, err := ReadWalSegment(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bad != 1 {
+		t.Errorf("got %d bad lines, want 1", bad)
+	}
+	if len(points) != 2 || apis[1] != "user_pay" || points[1] != "c,d\n" {
+		t.Errorf("got records %q %q", apis, points)
+	}
+
+	seg := &walSegment{name: name, pending: 2, bad: true}
+	seg.done(true)
+	seg.done(true)
+	if _, err = os.Stat(name + ".bad"); err != nil {
+		t.Errorf("segment not kept as .bad: %v", err)
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("segment left to replay again: %v", err)
+	}
+}
+
+func TestWalSegmentDone(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		saved []bool
+		kept  bool
+	}{
+		{[]bool{true, true}, false},
+		{[]bool{true, false}, true},
+	} {
+		name := filepath.Join(dir, "segment.wal")
+		writeTestFile(t, name, "")
+		seg := &walSegment{name: name, pending: int32(len(test.saved))}
+		for _, saved := range test.saved {
+			seg.done(saved)
+		}
+		_, err := os.Stat(name)
+		if kept := err == nil; kept != test.kept {
+			t.Errorf("batches saved %v: got segment kept %v", test.saved, kept)
+		}
+	}
+}